@@ -0,0 +1,118 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, alpha := range []uint8{0xff, 0x80} {
+		src := image.NewNRGBA(image.Rect(0, 0, 7, 5))
+		for y := 0; y < 5; y++ {
+			for x := 0; x < 7; x++ {
+				src.SetNRGBA(x, y, color.NRGBA{uint8(x * 30), uint8(y * 50), uint8(x + y), alpha})
+			}
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, src); err != nil {
+			t.Fatalf("FAILED: encode error %v", err)
+		}
+		// Rows of 7 pixels are padded to 24 bytes in 24-bit images.
+		if alpha == 0xff && buf.Len() != fileHeaderLen+infoHeaderLen+24*5 {
+			t.Errorf("FAILED: opaque image should be 24-bit, got %v bytes", buf.Len())
+		}
+		decoded, format, err := image.Decode(&buf)
+		if err != nil || format != "bmp" {
+			t.Fatalf("FAILED: decode error %v (format %q)", err, format)
+		}
+		for y := 0; y < 5; y++ {
+			for x := 0; x < 7; x++ {
+				if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != src.At(x, y) {
+					t.Fatalf("FAILED: pixel (%v,%v) is %v, expected %v", x, y, got, src.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestDecodePaletted(t *testing.T) {
+	// A 3x2 1-bit image with a black and white palette, stored bottom-up.
+	data := []byte{
+		'B', 'M', 70, 0, 0, 0, 0, 0, 0, 0, 62, 0, 0, 0,
+		40, 0, 0, 0, 3, 0, 0, 0, 2, 0, 0, 0, 1, 0, 1, 0,
+		0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		2, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0xff, 0xff, 0xff, 0,
+		0xa0, 0, 0, 0, // bottom row: 1 0 1
+		0x40, 0, 0, 0, // top row: 0 1 0
+	}
+	// The file size may also be left at 0.
+	for _, fileLen := range []byte{70, 0} {
+		data[2] = fileLen
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("FAILED: decode error %v with file size %v", err, fileLen)
+		}
+		expected := [][]uint8{{0, 1, 0}, {1, 0, 1}}
+		for y, row := range expected {
+			for x, index := range row {
+				if got := m.(*image.Paletted).ColorIndexAt(x, y); got != index {
+					t.Errorf("FAILED: pixel (%v,%v) has index %v, expected %v", x, y, got, index)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeInvalidSize(t *testing.T) {
+	// Return a 24-bit header of the given size, without pixels.
+	newHeader := func(width uint32, height uint32) []byte {
+		data := make([]byte, fileHeaderLen+infoHeaderLen)
+		copy(data, "BM")
+		binary.LittleEndian.PutUint32(data[2:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(data[10:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(data[14:], infoHeaderLen)
+		binary.LittleEndian.PutUint32(data[18:], width)
+		binary.LittleEndian.PutUint32(data[22:], height)
+		binary.LittleEndian.PutUint16(data[26:], 1)
+		binary.LittleEndian.PutUint16(data[28:], 24)
+		return data
+	}
+	sizes := [][2]uint32{{0x7fffffff, 0x7fffffff}, {4, 0x80000000}, {0, 4}, {4, 0}, {0xffffffff, 4}, {1 << 17, 1}}
+	for _, size := range sizes {
+		data := newHeader(size[0], size[1])
+		if _, err := Decode(bytes.NewReader(data)); err == nil {
+			t.Errorf("FAILED: image of size %v decoded", size)
+		}
+		if _, err := DecodeConfig(bytes.NewReader(data)); err == nil {
+			t.Errorf("FAILED: configuration of an image of size %v decoded", size)
+		}
+	}
+}
+
+func TestDecodeForgedSize(t *testing.T) {
+	// A 1-bit header of the largest size, whose file size matches its pixel array, without the pixels.
+	data := make([]byte, fileHeaderLen+infoHeaderLen+8)
+	copy(data, "BM")
+	binary.LittleEndian.PutUint32(data[2:], uint32(len(data))+(1<<16)/8*(1<<16))
+	binary.LittleEndian.PutUint32(data[10:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[14:], infoHeaderLen)
+	binary.LittleEndian.PutUint32(data[18:], 1<<16)
+	binary.LittleEndian.PutUint32(data[22:], 1<<16)
+	binary.LittleEndian.PutUint16(data[26:], 1)
+	binary.LittleEndian.PutUint16(data[28:], 1)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := Decode(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("FAILED: forged image decoded with error %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("FAILED: forged image allocated %v bytes", allocated)
+	}
+}
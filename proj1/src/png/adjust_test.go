@@ -0,0 +1,101 @@
+package png
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestColorSpaces(t *testing.T) {
+	colors := [][3]float64{{0, 0, 0}, {1, 1, 1}, {0.5, 0.5, 0.5}, {1, 0, 0}, {0.2, 0.7, 0.4}, {0.9, 0.3, 0.8}, {0.1, 0.2, 0.6}}
+	for _, c := range colors {
+		h, s, l := rgbToHSL(c[0], c[1], c[2])
+		r, g, b := hslToRGB(h, s, l)
+		if math.Abs(r-c[0])+math.Abs(g-c[1])+math.Abs(b-c[2]) > 1e-9 {
+			t.Errorf("FAILED: %v goes through HSL to %v %v %v", c, r, g, b)
+		}
+		h, s, v := rgbToHSV(c[0], c[1], c[2])
+		r, g, b = hsvToRGB(h, s, v)
+		if math.Abs(r-c[0])+math.Abs(g-c[1])+math.Abs(b-c[2]) > 1e-9 {
+			t.Errorf("FAILED: %v goes through HSV to %v %v %v", c, r, g, b)
+		}
+	}
+	if h, s, l := rgbToHSL(0, 1, 0); h != 120 || s != 1 || l != 0.5 {
+		t.Errorf("FAILED: green is HSL %v %v %v", h, s, l)
+	}
+}
+
+func TestColorEffectsIdentity(t *testing.T) {
+	neutral := []struct {
+		name   string
+		params map[string]any
+	}{
+		{"brightness", nil},
+		{"contrast", nil},
+		{"gamma", nil},
+		{"saturation", nil},
+		{"hue", map[string]any{"degrees": 360}},
+	}
+	for _, c := range neutral {
+		effect, err := NewEffect(c.name, c.params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newTestImage(11, 7)
+		effect.Apply(img, 0, 11*7)
+		for i := 0; i < len(img.in.Pix); i += 2 {
+			in := uint32(img.in.Pix[i])<<8 | uint32(img.in.Pix[i+1])
+			out := uint32(img.out.Pix[i])<<8 | uint32(img.out.Pix[i+1])
+			if absDiff(in, out) > 1 {
+				t.Fatalf("FAILED: neutral %v changes a channel from %v to %v", c.name, in, out)
+			}
+		}
+	}
+}
+
+func TestColorEffects(t *testing.T) {
+	cases := []struct {
+		name     string
+		params   map[string]any
+		in, want [3]uint16
+	}{
+		{"brightness", map[string]any{"amount": 0.25}, [3]uint16{0x4000, 0xf000, 0}, [3]uint16{0x8000, 0xffff, 0x4000}},
+		{"contrast", map[string]any{"factor": 2}, [3]uint16{0x4000, 0x8000, 0xc000}, [3]uint16{0, 0x8000, 0xffff}},
+		{"gamma", map[string]any{"gamma": 2}, [3]uint16{0x4000, 0, 0xffff}, [3]uint16{0x8000, 0, 0xffff}},
+		{"saturation", map[string]any{"factor": 0}, [3]uint16{0xffff, 0, 0}, [3]uint16{0x8000, 0x8000, 0x8000}},
+		{"hue", map[string]any{"degrees": 120}, [3]uint16{0xffff, 0, 0}, [3]uint16{0, 0xffff, 0}},
+		{"hue", map[string]any{"degrees": -120}, [3]uint16{0xffff, 0, 0}, [3]uint16{0, 0, 0xffff}},
+	}
+	for _, c := range cases {
+		effect, err := NewEffect(c.name, c.params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newStepImage(1, 1, func(x int, y int) uint16 { return 0 })
+		writePixel(img.in.Pix, 0, c.in[0], c.in[1], c.in[2], 0xffff)
+		effect.Apply(img, 0, 1)
+		r, g, b, _ := readPixel(img.out.Pix, 0)
+		for i, v := range []uint32{r, g, b} {
+			if absDiff(v, uint32(c.want[i])) > 1 {
+				t.Errorf("FAILED: %v %v maps %v to %v %v %v, expected %v", c.name, c.params, c.in, r, g, b, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestColorEffectsKeepAlpha(t *testing.T) {
+	// A translucent red is rotated on its non-premultiplied color.
+	effect, _ := NewEffect("hue", map[string]any{"degrees": 120})
+	img := newStepImage(3, 1, func(x int, y int) uint16 { return 0 })
+	writePixel(img.in.Pix, 8, 0x8000, 0, 0, 0x8000)
+	effect.Apply(img, 1, 2)
+	r, g, b, a := readPixel(img.out.Pix, 8)
+	if r != 0 || absDiff(g, 0x8000) > 1 || b != 0 || a != 0x8000 {
+		t.Errorf("FAILED: translucent red rotates to %v %v %v %v", r, g, b, a)
+	}
+	// The rest of the output buffer is untouched.
+	if !bytes.Equal(img.out.Pix[:8], make([]byte, 8)) || !bytes.Equal(img.out.Pix[16:], make([]byte, 8)) {
+		t.Errorf("FAILED: hue wrote outside of its slice")
+	}
+}
@@ -0,0 +1,78 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBoxBlurMatchesKernel(t *testing.T) {
+	if _, err := NewEffect("boxblur", map[string]any{"border": "mirror"}); err == nil {
+		t.Errorf("FAILED: mirror border should be rejected by the box blur")
+	}
+	for _, border := range []Border{BorderZero, BorderRenormalize} {
+		for _, radius := range []int{1, 3, 30} {
+			size := 2*radius + 1
+			weights := make([]float64, size*size)
+			for i := range weights {
+				weights[i] = 1 / float64(len(weights))
+			}
+			expected := newTestImage(19, 14)
+			expected.PerformKernel(&Kernel{Size: size, Weights: weights}, border, 0, 19*14)
+
+			effect, err := NewEffect("boxblur", map[string]any{"radius": radius, "border": border.String()})
+			if err != nil {
+				t.Fatalf("FAILED: %v", err)
+			}
+			img := newTestImage(19, 14)
+			effect.Apply(img, 0, 100)
+			effect.Apply(img, 100, 19*14)
+			for i := 0; i < len(img.out.Pix); i += 8 {
+				r1, g1, b1, a1 := readPixel(img.out.Pix, i)
+				r2, g2, b2, a2 := readPixel(expected.out.Pix, i)
+				if absDiff(r1, r2) > 1 || absDiff(g1, g2) > 1 || absDiff(b1, b2) > 1 || a1 != a2 {
+					t.Fatalf("FAILED: %v box blur of radius %v pixel %v is %v,%v,%v,%v, expected %v,%v,%v,%v",
+						border, radius, i/8, r1, g1, b1, a1, r2, g2, b2, a2)
+				}
+			}
+		}
+	}
+}
+
+func TestBoxBlurStages(t *testing.T) {
+	effect, _ := NewEffect("boxblur", map[string]any{"radius": 4})
+	expected := newTestImage(23, 17)
+	effect.Apply(expected, 0, 23*17)
+	// Chunks smaller than a row, spanning several rows, and the whole image.
+	for _, chunk := range []int{5, 23, 40, 23 * 17} {
+		img := newTestImage(23, 17)
+		applyStages(img, effect, chunk)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: box blur stages with chunks of %v pixels differ from the direct blur", chunk)
+		}
+	}
+}
+
+func TestBoxBlurStagesWithDifferentSlices(t *testing.T) {
+	effect, _ := NewEffect("boxblur", map[string]any{"radius": 2})
+	expected := newTestImage(23, 17)
+	effect.Apply(expected, 0, 23*17)
+	// Each stage is sliced differently, the blocks of the first stage end within the slices of the second.
+	for _, chunks := range [][3]int{{23 * 3, 23 * 5, 40}, {23 * 5, 23 * 2, 23 * 17}, {7, 23 * 17, 23}} {
+		img := newTestImage(23, 17)
+		for i, stage := range Stages(effect, img) {
+			numPixels := img.Prepare(stage)
+			for start := 0; start < numPixels; start += chunks[i] {
+				end := start + chunks[i]
+				if end > numPixels {
+					end = numPixels
+				}
+				stage.Apply(img, start, end)
+			}
+			img.Swap()
+		}
+		img.Swap()
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: box blur stages sliced in chunks of %v pixels differ from the direct blur", chunks)
+		}
+	}
+}
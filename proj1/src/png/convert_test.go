@@ -0,0 +1,40 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestConvertMatchesRGBA(t *testing.T) {
+	bounds := image.Rect(-3, 2, 38, 29)
+	nrgba := image.NewNRGBA(bounds)
+	rgba := image.NewRGBA(bounds)
+	gray := image.NewGray(bounds)
+	paletted := image.NewPaletted(bounds, color.Palette{color.Black, color.White, color.NRGBA{200, 100, 50, 128}})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := uint8(x*37 + y*11)
+			nrgba.SetNRGBA(x, y, color.NRGBA{v, v + 50, v + 100, v + 7})
+			rgba.SetRGBA(x, y, color.RGBA{v / 2, v / 3, v / 4, v})
+			gray.SetGray(x, y, color.Gray{v})
+			paletted.SetColorIndex(x, y, v%3)
+		}
+	}
+	for _, src := range []image.Image{nrgba, rgba, gray, paletted} {
+		for _, threads := range []int{0, 1, 4, 100} {
+			dst := image.NewRGBA64(bounds)
+			convert(dst, src, threads)
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					r1, g1, b1, a1 := src.At(x, y).RGBA()
+					r2, g2, b2, a2 := dst.At(x, y).RGBA()
+					if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+						t.Fatalf("FAILED: %T with %v threads pixel (%v,%v) is %v,%v,%v,%v, expected %v,%v,%v,%v",
+							src, threads, x, y, r2, g2, b2, a2, r1, g1, b1, a1)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import "math"
+
+// The largest parameters of the noise removal effects.
+const (
+	maxMedianRadius = 25
+	maxSpatialSigma = 25
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "median", Params: []string{"border", "radius"}, New: newMedianEffect})
+	RegisterEffect(EffectSpec{Name: "bilateral", Params: []string{"border", "sigmaSpatial", "sigmaRange"}, New: newBilateralEffect})
+}
+
+// A medianEffect replaces each channel of a pixel by its median over the
+// (2*radius+1) x (2*radius+1) neighbourhood of the pixel.
+type medianEffect struct {
+	radius int
+	border Border
+}
+
+// A bilateralEffect averages the neighbourhood of each pixel, weighted by their distance
+// and by their color difference to the pixel, so that edges are preserved.
+type bilateralEffect struct {
+	sigmaSpatial float64
+	sigmaRange   float64
+	border       Border
+	spatial      []float64 // The spatial weights of the neighbourhood in row-major order
+}
+
+// Create a median filter with the "radius" parameter, 1 by default.
+func newMedianEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	radius, err := paramInt(params, "radius", 1, 1, maxMedianRadius)
+	if err != nil {
+		return nil, err
+	}
+	return &medianEffect{radius: radius, border: border}, nil
+}
+
+func (e *medianEffect) Name() string { return "median" }
+
+func (e *medianEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "radius": e.radius}
+}
+
+func (e *medianEffect) Radius() int { return e.radius }
+
+func (e *medianEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *medianEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Apply the median filter to the image slice, in the float planes if linear.
+// Neighbours outside of the image are zero with the zero border, and skipped with the renormalize border.
+func (e *medianEffect) apply(img *Image, start int, end int, linear bool) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	size := 2*e.radius + 1
+	stride, step := img.inputLayout(linear)
+
+	rowOffs := make([]int, size)
+	colOffs := make([]int, size)
+	var values [3][]float64
+	for c := range values {
+		values[c] = make([]float64, 0, size*size)
+	}
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			e.border.offsets(rowOffs, y-e.radius, yMin, yMax, stride)
+		}
+		e.border.offsets(colOffs, x-e.radius, xMin, xMax, step)
+
+		for c := range values {
+			values[c] = values[c][:0]
+		}
+		for _, rowOff := range rowOffs {
+			for _, colOff := range colOffs {
+				if rowOff >= 0 && colOff >= 0 {
+					r, g, b, _ := img.readInput(rowOff+colOff, linear)
+					values[0] = append(values[0], r)
+					values[1] = append(values[1], g)
+					values[2] = append(values[2], b)
+				} else if e.border == BorderZero {
+					values[0] = append(values[0], 0)
+					values[1] = append(values[1], 0)
+					values[2] = append(values[2], 0)
+				}
+			}
+		}
+		_, _, _, a := img.readInput((k/n)*stride+(k%n)*step, linear)
+		if linear {
+			writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride), median(values[0]), median(values[1]), median(values[2]), a)
+			continue
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride),
+			uint16(median(values[0])), uint16(median(values[1])), uint16(median(values[2])), uint16(a))
+	}
+}
+
+// Return the median of the values, the upper one of an even number of values, which are reordered.
+func median(values []float64) float64 {
+	// Select the middle value, partitioning the range that holds it around a pivot.
+	mid := len(values) / 2
+	lo, hi := 0, len(values)-1
+	for lo < hi {
+		pivot := values[(lo+hi)/2]
+		i, j := lo, hi
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		if mid <= j {
+			hi = j
+		} else if mid >= i {
+			lo = i
+		} else {
+			break
+		}
+	}
+	return values[mid]
+}
+
+// Create a bilateral filter, where "sigmaSpatial" is the standard deviation of the distance
+// weights in pixels, 2 by default, and "sigmaRange" the standard deviation of the color difference
+// weights as a fraction of the largest intensity, 0.1 by default. The neighbourhood covers
+// 2 sigmaSpatial on each side of a pixel.
+func newBilateralEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	sigmaSpatial, err := paramFloat(params, "sigmaSpatial", 2, 0.1, maxSpatialSigma)
+	if err != nil {
+		return nil, err
+	}
+	sigmaRange, err := paramFloat(params, "sigmaRange", 0.1, 0.001, 10)
+	if err != nil {
+		return nil, err
+	}
+	radius := int(math.Ceil(2 * sigmaSpatial))
+	size := 2*radius + 1
+	spatial := make([]float64, size*size)
+	for i := range spatial {
+		dx, dy := float64(i%size-radius), float64(i/size-radius)
+		spatial[i] = math.Exp(-(dx*dx + dy*dy) / (2 * sigmaSpatial * sigmaSpatial))
+	}
+	return &bilateralEffect{sigmaSpatial: sigmaSpatial, sigmaRange: sigmaRange, border: border, spatial: spatial}, nil
+}
+
+func (e *bilateralEffect) Name() string { return "bilateral" }
+
+func (e *bilateralEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "sigmaSpatial": e.sigmaSpatial, "sigmaRange": e.sigmaRange}
+}
+
+func (e *bilateralEffect) Radius() int { return int(math.Ceil(2 * e.sigmaSpatial)) }
+
+func (e *bilateralEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *bilateralEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Apply the bilateral filter to the image slice, in the float planes if linear.
+// Neighbours outside of the image are zero with the zero border, and skipped otherwise
+// since the weights are normalized anyway.
+func (e *bilateralEffect) apply(img *Image, start int, end int, linear bool) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := e.Radius()
+	size := 2*radius + 1
+	stride, step := img.inputLayout(linear)
+	// The color differences are measured with the channels scaled to [0, 1].
+	rangeScale := -1 / (2 * e.sigmaRange * e.sigmaRange * 65535 * 65535)
+
+	rowOffs := make([]int, size)
+	colOffs := make([]int, size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			e.border.offsets(rowOffs, y-radius, yMin, yMax, stride)
+		}
+		e.border.offsets(colOffs, x-radius, xMin, xMax, step)
+
+		r0, g0, b0, a := img.readInput((k/n)*stride+(k%n)*step, linear)
+		rNew, gNew, bNew, wSum := float64(0), float64(0), float64(0), float64(0)
+		kIndex := 0
+		for _, rowOff := range rowOffs {
+			for _, colOff := range colOffs {
+				var r, g, b float64
+				if rowOff >= 0 && colOff >= 0 {
+					r, g, b, _ = img.readInput(rowOff+colOff, linear)
+				} else if e.border != BorderZero {
+					kIndex += 1
+					continue
+				}
+				dr, dg, db := r-r0, g-g0, b-b0
+				w := e.spatial[kIndex] * math.Exp((dr*dr+dg*dg+db*db)*rangeScale)
+				rNew += r * w
+				gNew += g * w
+				bNew += b * w
+				wSum += w
+				kIndex += 1
+			}
+		}
+		// The center pixel always has weight 1.
+		if linear {
+			writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride), clampFloat(rNew/wSum), clampFloat(gNew/wSum), clampFloat(bNew/wSum), a)
+			continue
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), clamp(rNew/wSum), clamp(gNew/wSum), clamp(bNew/wSum), uint16(a))
+	}
+}
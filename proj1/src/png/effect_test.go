@@ -0,0 +1,168 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewEffect(t *testing.T) {
+	if _, err := NewEffect("X", nil); err == nil {
+		t.Errorf("FAILED: unknown effect should be rejected")
+	}
+	if _, err := NewEffect("G", map[string]any{"border": "clamp"}); err == nil {
+		t.Errorf("FAILED: grayscale should not take a border")
+	}
+	if _, err := NewEffect("blur", map[string]any{"border": "sideways"}); err == nil {
+		t.Errorf("FAILED: unknown border mode should be rejected")
+	}
+	effect, err := NewEffect("B", map[string]any{"border": "mirror"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if effect.Name() != "blur" || effect.Radius() != 1 || effect.Params()["border"] != "mirror" {
+		t.Errorf("FAILED: blur effect has name %q, radius %v and params %v", effect.Name(), effect.Radius(), effect.Params())
+	}
+}
+
+func TestEffectsMatchMethods(t *testing.T) {
+	methods := map[string]func(img *Image, start int, end int){
+		"G": func(img *Image, start int, end int) { img.Grayscale(start, end) },
+		"S": func(img *Image, start int, end int) { img.Sharpen(BorderClamp, start, end) },
+		"E": func(img *Image, start int, end int) { img.EdgeDetection(BorderClamp, start, end) },
+		"B": func(img *Image, start int, end int) { img.Blur(BorderClamp, start, end) },
+	}
+	for name, method := range methods {
+		params := map[string]any{"border": "clamp"}
+		if name == "G" {
+			params = nil
+		}
+		effect, err := NewEffect(name, params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		expected := newTestImage(9, 7)
+		method(expected, 0, 63)
+		img := newTestImage(9, 7)
+		// Apply the effect in two chunks.
+		effect.Apply(img, 0, 20)
+		effect.Apply(img, 20, 63)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: effect %v differs from its method", effect.Name())
+		}
+	}
+}
+
+func TestEffectParams(t *testing.T) {
+	invalid := []struct {
+		name   string
+		params map[string]any
+	}{
+		{"blur", map[string]any{"radius": 0.0}},
+		{"blur", map[string]any{"radius": 2.5}},
+		{"blur", map[string]any{"radius": "4"}},
+		{"sharpen", map[string]any{"amount": -1.0}},
+		{"edge", map[string]any{"amount": 1.0}},
+	}
+	for _, c := range invalid {
+		if _, err := NewEffect(c.name, c.params); err == nil {
+			t.Errorf("FAILED: %v with %v should be rejected", c.name, c.params)
+		}
+	}
+
+	// The default parameters are the fixed kernels.
+	for _, name := range []string{"sharpen", "blur"} {
+		effect, _ := NewEffect(name, map[string]any{"border": "wrap"})
+		if err := ValidateEffect(effect); err != nil {
+			t.Errorf("FAILED: %v", err)
+		}
+		expected := newTestImage(8, 6)
+		if name == "sharpen" {
+			expected.Sharpen(BorderWrap, 0, 48)
+		} else {
+			expected.Blur(BorderWrap, 0, 48)
+		}
+		img := newTestImage(8, 6)
+		effect.Apply(img, 0, 48)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: default %v differs from its method", name)
+		}
+	}
+
+	effect, err := NewEffect("blur", map[string]any{"radius": 4.0})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if effect.Radius() != 4 || effect.Params()["radius"] != 4 {
+		t.Errorf("FAILED: blur radius %v with params %v", effect.Radius(), effect.Params())
+	}
+	if err := ValidateEffect(effect); err != nil {
+		t.Errorf("FAILED: %v", err)
+	}
+	// A flat image stays flat under any blur radius, up to the truncation of the sums.
+	img := newTestImage(12, 10)
+	for i := 0; i < len(img.in.Pix); i += 8 {
+		writePixel(img.in.Pix, i, 0x1234, 0x5678, 0x9abc, 0xffff)
+	}
+	effect, _ = NewEffect("blur", map[string]any{"radius": 4.0, "border": "clamp"})
+	effect.Apply(img, 0, 120)
+	for i := 0; i < len(img.out.Pix); i += 8 {
+		if r, g, b, _ := readPixel(img.out.Pix, i); absDiff(r, 0x1234) > 1 || absDiff(g, 0x5678) > 1 || absDiff(b, 0x9abc) > 1 {
+			t.Fatalf("FAILED: blurred flat pixel is %x,%x,%x", r, g, b)
+		}
+	}
+}
+
+func TestCustomKernel(t *testing.T) {
+	// The edge kernel given in effects.txt is the edge method.
+	matrix := []any{-1.0, -1.0, -1.0, -1.0, 8.0, -1.0, -1.0, -1.0, -1.0}
+	effect, err := NewEffect("K", map[string]any{"matrix": matrix, "border": "wrap"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if err := ValidateEffect(effect); err != nil {
+		t.Errorf("FAILED: %v", err)
+	}
+	expected := newTestImage(9, 7)
+	expected.EdgeDetection(BorderWrap, 0, 63)
+	img := newTestImage(9, 7)
+	effect.Apply(img, 0, 63)
+	if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+		t.Errorf("FAILED: edge kernel differs from the edge method")
+	}
+
+	// A 5x5 identity kernel with a divisor, a bias, and only the red channel.
+	identity := make([]any, 25)
+	for i := range identity {
+		identity[i] = 0.0
+	}
+	identity[12] = 2.0
+	effect, err = NewEffect("kernel", map[string]any{"matrix": identity, "divisor": 4, "bias": 0.25, "channels": "r"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if effect.Radius() != 2 {
+		t.Errorf("FAILED: 5x5 kernel has radius %v", effect.Radius())
+	}
+	img = newTestImage(9, 7)
+	effect.Apply(img, 0, 63)
+	for i := 0; i < len(img.in.Pix); i += 8 {
+		r, g, b, a := readPixel(img.in.Pix, i)
+		r2, g2, b2, a2 := readPixel(img.out.Pix, i)
+		if absDiff(r2, r/2+0x4000) > 1 || g2 != g || b2 != b || a2 != a {
+			t.Fatalf("FAILED: pixel %x,%x,%x,%x maps to %x,%x,%x,%x", r, g, b, a, r2, g2, b2, a2)
+		}
+	}
+
+	invalid := []map[string]any{
+		{},
+		{"matrix": []any{1.0, 1.0, 1.0, 1.0}},
+		{"matrix": []any{1.0}, "divisor": 0},
+		{"matrix": []any{1.0}, "channels": "rgba"},
+		{"matrix": []any{1.0}, "bias": 2},
+	}
+	for _, params := range invalid {
+		if _, err := NewEffect("kernel", params); err == nil {
+			t.Errorf("FAILED: kernel with %v should be rejected", params)
+		}
+	}
+}
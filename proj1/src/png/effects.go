@@ -3,75 +3,191 @@
 package png
 
 import (
-	"image/color"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Register the built-in effects, by name and by their letter in effects.txt.
+func init() {
+	RegisterEffect(EffectSpec{Name: "grayscale", Aliases: []string{"G"}, New: newGrayscaleEffect})
+	RegisterEffect(EffectSpec{Name: "sharpen", Aliases: []string{"S"}, Params: []string{"border", "amount"}, New: newSharpenEffect})
+	RegisterEffect(EffectSpec{Name: "edge", Aliases: []string{"E"}, Params: []string{"border"}, New: newEdgeEffect})
+	RegisterEffect(EffectSpec{Name: "blur", Aliases: []string{"B"}, Params: []string{"border", "radius"}, New: newBlurEffect})
+	RegisterEffect(EffectSpec{Name: "kernel", Aliases: []string{"K"}, Params: []string{"border", "matrix", "divisor", "bias", "channels"},
+		New: newCustomKernelEffect})
+}
+
+// The largest parameters of the built-in effects.
+const (
+	maxBlurRadius    = 100
+	maxSharpenAmount = 100
+	maxKernelSize    = 25
+	maxKernelDivisor = 1e6
 )
 
 // Grayscale applies a grayscale filtering effect to the image slice from start to end position, concatenating row-wise.
 func (img *Image) Grayscale(start int, end int) {
-	yMin, _, xMin, xMax := img.GetBounds() // Get image bounds.
-	n := xMax - xMin                       // Get the number of pixel in a row.
+	_, _, xMin, xMax := img.GetBounds() // Get image bounds.
+	n := xMax - xMin                    // Get the number of pixel in a row.
+	inPix, inStride := img.in.Pix, img.in.Stride
+	outPix, outStride := img.out.Pix, img.out.Stride
 
 	for i := start; i < end; i++ {
-		// Perform position matching
-		y := i/n + yMin
-		x := i%n + xMin
-		//Returns the pixel (i.e., RGBA) value at a (x,y) position
-		// Note: These get returned as int32 so based on the math you'll
-		// be performing you'll need to do a conversion to float64(..)
-		r, g, b, a := img.in.At(x, y).RGBA()
-
-		//Note: The values for r,g,b,a for this assignment will range between [0, 65535].
-		//For certain computations (i.e., convolution) the values might fall outside this
+		// Read the pixel (i.e., RGBA) value directly from the Pix buffer.
+		// Note: The values for r,g,b,a range between [0, 65535].
+		r, g, b, a := readPixel(inPix, pixOffset(i, n, inStride))
+
+		// For certain computations (i.e., convolution) the values might fall outside this
 		// range so you need to clamp them between those values.
 		greyC := clamp(float64(r+g+b) / 3.0)
 
 		//Note: The values need to be stored back as uint16.
-		img.out.Set(x, y, color.RGBA64{greyC, greyC, greyC, uint16(a)})
+		writePixel(outPix, pixOffset(i, n, outStride), greyC, greyC, greyC, uint16(a))
 	}
 }
 
-// Perform the designated kernel to the image slice from start to end position, concatenating row-wise.
-func (img *Image) PerformKernel(kernel *[9]float64, start int, end int) {
-	yMin, yMax, xMin, xMax := img.GetBounds()
-	n := xMax - xMin
-	for k := start; k < end; k++ {
-		y := k/n + yMin
-		x := k%n + xMin
-		kIndex := 0
-		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
-		for i := -1; i <= 1; i++ {
-			for j := -1; j <= 1; j++ {
-				if (yMin <= (y + i)) && ((y + i) < yMax) && (xMin <= (x + j)) && ((x + j) < xMax) {
-					r, g, b, a := img.in.At(x+j, y+i).RGBA()
-					if j == 0 && i == 0 {
-						aNew = float64(a)
-					}
-					kMult := kernel[kIndex]
-					rNew += float64(r) * kMult
-					gNew += float64(g) * kMult
-					bNew += float64(b) * kMult
-				}
-				kIndex += 1
-			}
-		}
-		img.out.Set(x, y, color.RGBA64{clamp(rNew), clamp(gNew), clamp(bNew), clamp(aNew)})
-	}
-}
+// The kernels of the built-in convolution effects.
+var (
+	sharpenKernel = &Kernel{Size: 3, Weights: []float64{0, -1, 0, -1, 5, -1, 0, -1, 0}}
+	edgeKernel    = &Kernel{Size: 3, Weights: []float64{-1, -1, -1, -1, 8, -1, -1, -1, -1}}
+	blurKernel    = &Kernel{Size: 3, Weights: []float64{1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0}}
+)
 
 // Sharpen effect on the image.
-func (img *Image) Sharpen(start int, end int) {
-	kernel := [9]float64{0, -1, 0, -1, 5, -1, 0, -1, 0}
-	img.PerformKernel(&kernel, start, end)
+func (img *Image) Sharpen(border Border, start int, end int) {
+	img.PerformKernel(sharpenKernel, border, start, end)
 }
 
 // Edge detection on the image.
-func (img *Image) EdgeDetection(start int, end int) {
-	kernel := [9]float64{-1, -1, -1, -1, 8, -1, -1, -1, -1}
-	img.PerformKernel(&kernel, start, end)
+func (img *Image) EdgeDetection(border Border, start int, end int) {
+	img.PerformKernel(edgeKernel, border, start, end)
 }
 
 // Blur the image.
-func (img *Image) Blur(start int, end int) {
-	kernel := [9]float64{1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0, 1 / 9.0}
-	img.PerformKernel(&kernel, start, end)
+func (img *Image) Blur(border Border, start int, end int) {
+	img.PerformKernel(blurKernel, border, start, end)
+}
+
+// A kernelEffect convolves the image with a kernel.
+type kernelEffect struct {
+	name   string
+	kernel *Kernel
+	border Border
+	params map[string]any // The parameters the kernel was made from, excluding the border
+}
+
+func (e *kernelEffect) Name() string { return e.name }
+
+func (e *kernelEffect) Params() map[string]any {
+	params := map[string]any{"border": e.border.String()}
+	for k, v := range e.params {
+		params[k] = v
+	}
+	return params
+}
+
+func (e *kernelEffect) Radius() int { return e.kernel.Radius() }
+
+func (e *kernelEffect) Apply(img *Image, start int, end int) {
+	img.PerformKernel(e.kernel, e.border, start, end)
+}
+
+func (e *kernelEffect) ApplyLinear(img *Image, start int, end int) {
+	img.performKernelLinear(e.kernel, e.border, start, end)
+}
+
+// Create a sharpen effect, where the "amount" parameter scales the difference
+// between a pixel and its neighbours, 1 by default.
+func newSharpenEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	amount, err := paramFloat(params, "amount", 1, 0, maxSharpenAmount)
+	if err != nil {
+		return nil, err
+	}
+	kernel := &Kernel{Size: 3, Weights: []float64{0, -amount, 0, -amount, 1 + 4*amount, -amount, 0, -amount, 0}}
+	return &kernelEffect{name: "sharpen", kernel: kernel, border: border, params: map[string]any{"amount": amount}}, nil
+}
+
+// Create an edge detection effect.
+func newEdgeEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	return &kernelEffect{name: "edge", kernel: edgeKernel, border: border}, nil
+}
+
+// Create a box blur effect averaging the (2*radius+1) x (2*radius+1) neighbourhood of a pixel,
+// where the "radius" parameter is 1 by default. Larger radii are performed as two passes.
+func newBlurEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	radius, err := paramInt(params, "radius", 1, 1, maxBlurRadius)
+	if err != nil {
+		return nil, err
+	}
+	kernel := blurKernel
+	if radius > 1 {
+		factor := make([]float64, 2*radius+1)
+		for i := range factor {
+			factor[i] = 1 / float64(len(factor))
+		}
+		kernel = &Kernel{Size: len(factor), Row: factor, Col: factor}
+	}
+	return &kernelEffect{name: "blur", kernel: kernel, border: border, params: map[string]any{"radius": radius}}, nil
+}
+
+// Create a user-defined convolution effect from the row-major "matrix" of a square kernel of odd size,
+// the "divisor" of the sums, 1 by default, the "bias" added to them as a fraction of the largest value,
+// 0 by default, and the rgb "channels" it applies to, "rgb" by default.
+func newCustomKernelEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	var sizes []int
+	for size := 1; size <= maxKernelSize; size += 2 {
+		sizes = append(sizes, size*size)
+	}
+	weights, err := paramFloats(params, "matrix", sizes...)
+	if err != nil {
+		return nil, err
+	}
+	if weights == nil {
+		return nil, errors.New("png: kernel effect needs a matrix")
+	}
+	divisor, err := paramFloat(params, "divisor", 1, -maxKernelDivisor, maxKernelDivisor)
+	if err != nil {
+		return nil, err
+	}
+	if divisor == 0 {
+		return nil, errors.New("png: kernel divisor must not be zero")
+	}
+	bias, err := paramFloat(params, "bias", 0, -1, 1)
+	if err != nil {
+		return nil, err
+	}
+	channels := "rgb"
+	if v, ok := params["channels"]; ok {
+		if channels, ok = v.(string); !ok {
+			return nil, fmt.Errorf("png: parameter %q must be a string, got %v", "channels", v)
+		}
+		if channels == "" || strings.Trim(channels, "rgb") != "" {
+			return nil, fmt.Errorf("png: kernel channels must be some of \"rgb\", got %q", channels)
+		}
+	}
+	kernel, err := NewKernel(int(math.Sqrt(float64(len(weights)))), weights)
+	if err != nil {
+		return nil, err
+	}
+	kernel.Divisor, kernel.Bias, kernel.Channels = divisor, bias, channels
+	return &kernelEffect{name: "kernel", kernel: kernel, border: border,
+		params: map[string]any{"matrix": append([]float64(nil), weights...), "divisor": divisor, "bias": bias, "channels": channels}}, nil
 }
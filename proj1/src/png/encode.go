@@ -0,0 +1,457 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// The PNG color types.
+const (
+	colorGray      = 0
+	colorRGB       = 2
+	colorPaletted  = 3
+	colorGrayAlpha = 4
+	colorRGBA      = 6
+)
+
+// The PNG row filter types.
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+	numFilters
+)
+
+// NoCompression disables the zlib compression when used as the SaveOptions.CompressionLevel.
+const NoCompression = -1
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// ErrNotGray means that the image was saved as grayscale but has colored pixels.
+var ErrNotGray = errors.New("png: cannot save a colored image as grayscale")
+
+// ErrNotBinary means that the image was saved with 1 bit per pixel but has pixels
+// that are neither black nor white, or translucent pixels.
+var ErrNotBinary = errors.New("png: cannot save an image that is not opaque black and white with 1 bit")
+
+// An encoder writes the output buffer of an image as a PNG file.
+type encoder struct {
+	img       *Image
+	w         io.Writer
+	width     int
+	height    int
+	colorType int
+	bitDepth  int
+	level     int            // The zlib compression level
+	threads   int            // The number of goroutines compressing the image data
+	palette   map[uint32]int // The palette index of each 8-bit non-premultiplied color
+	colors    []uint32       // The palette colors in index order
+	err       error
+}
+
+// Write the output buffer of the image to w in PNG format as specified by the options.
+func (img *Image) encodePNG(w io.Writer, options SaveOptions) error {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	e := &encoder{img: img, w: w, width: xMax - xMin, height: yMax - yMin, threads: options.Threads}
+	if e.width <= 0 || e.height <= 0 {
+		return errors.New("png: cannot save an empty image")
+	}
+
+	// Choose the bit depth, the source bit depth is kept by default.
+	e.bitDepth = options.BitDepth
+	if e.bitDepth == 0 {
+		e.bitDepth = img.depth
+	}
+	if e.bitDepth != 1 && e.bitDepth != 8 {
+		e.bitDepth = 16
+	}
+
+	// Choose the color type.
+	opaque := img.out.Opaque()
+	if e.bitDepth == 1 {
+		if !opaque || !img.isBinary() {
+			return ErrNotBinary
+		}
+		e.colorType = colorGray
+	} else if options.Grayscale {
+		if !img.isGray() {
+			return ErrNotGray
+		}
+		e.colorType = colorGrayAlpha
+		if opaque && !options.KeepAlpha {
+			e.colorType = colorGray
+		}
+	} else {
+		e.colorType = colorRGBA
+		if opaque && !options.KeepAlpha {
+			e.colorType = colorRGB
+		}
+	}
+	if options.Palette && e.bitDepth == 8 && !options.Grayscale {
+		if e.buildPalette() {
+			e.colorType = colorPaletted
+		}
+	}
+
+	switch {
+	case options.CompressionLevel == NoCompression:
+		e.level = zlib.NoCompression
+	case options.CompressionLevel == 0:
+		e.level = zlib.DefaultCompression
+	case options.CompressionLevel >= zlib.BestSpeed && options.CompressionLevel <= zlib.BestCompression:
+		e.level = options.CompressionLevel
+	default:
+		return errors.New("png: invalid compression level")
+	}
+
+	_, e.err = io.WriteString(w, pngHeader)
+	e.writeIHDR()
+	if e.colorType == colorPaletted {
+		e.writePLTE()
+	}
+	if e.err == nil {
+		if e.threads > 1 {
+			e.writeIDATsParallel()
+		} else {
+			e.writeIDATs()
+		}
+	}
+	e.writeChunk(nil, "IEND")
+	return e.err
+}
+
+// Report whether every pixel of the output buffer has equal rgb channels.
+func (img *Image) isGray() bool {
+	pix := img.out.Pix
+	for i := 0; i < len(pix); i += 8 {
+		r, g, b, _ := readPixel(pix, i)
+		if r != g || g != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether every pixel of the output buffer is black or white.
+func (img *Image) isBinary() bool {
+	pix := img.out.Pix
+	for i := 0; i < len(pix); i += 8 {
+		r, g, b, _ := readPixel(pix, i)
+		if r != g || g != b || (r != 0 && r != 0xffff) {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect the colors of the output buffer in a palette.
+// Return false if the image has more than 256 colors.
+func (e *encoder) buildPalette() bool {
+	e.palette = make(map[uint32]int)
+	pix := e.img.out.Pix
+	for i := 0; i < len(pix); i += 8 {
+		r, g, b, a := readPixel(pix, i)
+		c := packNRGBA(r, g, b, a)
+		if _, ok := e.palette[c]; !ok {
+			if len(e.palette) == 256 {
+				e.palette, e.colors = nil, nil
+				return false
+			}
+			e.palette[c] = len(e.colors)
+			e.colors = append(e.colors, c)
+		}
+	}
+	return true
+}
+
+// Convert a premultiplied 16-bit color to non-premultiplied 8-bit rgba packed in an uint32.
+func packNRGBA(r uint32, g uint32, b uint32, a uint32) uint32 {
+	r, g, b = unpremultiply(r, g, b, a)
+	return uint32(to8Bit(r))<<24 | uint32(to8Bit(g))<<16 | uint32(to8Bit(b))<<8 | uint32(to8Bit(a))
+}
+
+// Round a 16-bit channel to the nearest 8-bit value.
+func to8Bit(v uint32) uint8 {
+	return uint8((v*255 + 32767) / 65535)
+}
+
+// Convert premultiplied 16-bit rgb channels to non-premultiplied ones.
+// A channel above alpha, which is not a valid premultiplied color, saturates instead of wrapping.
+func unpremultiply(r uint32, g uint32, b uint32, a uint32) (uint32, uint32, uint32) {
+	if a == 0xffff {
+		return r, g, b
+	}
+	if a == 0 {
+		return 0, 0, 0
+	}
+	return saturate(r * 0xffff / a), saturate(g * 0xffff / a), saturate(b * 0xffff / a)
+}
+
+// Return v limited to the largest 16-bit value.
+func saturate(v uint32) uint32 {
+	if v > 0xffff {
+		return 0xffff
+	}
+	return v
+}
+
+// Write a chunk with the given name and data.
+func (e *encoder) writeChunk(data []byte, name string) {
+	if e.err != nil {
+		return
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+	var footer [4]byte
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:8])
+	crc.Write(data)
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	if _, e.err = e.w.Write(header[:]); e.err != nil {
+		return
+	}
+	if _, e.err = e.w.Write(data); e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(footer[:])
+}
+
+func (e *encoder) writeIHDR() {
+	var data [13]byte
+	binary.BigEndian.PutUint32(data[0:4], uint32(e.width))
+	binary.BigEndian.PutUint32(data[4:8], uint32(e.height))
+	data[8] = uint8(e.bitDepth)
+	data[9] = uint8(e.colorType)
+	// Compression, filter and interlace methods are all 0.
+	e.writeChunk(data[:], "IHDR")
+}
+
+func (e *encoder) writePLTE() {
+	plte := make([]byte, 0, 3*len(e.colors))
+	trns := make([]byte, 0, len(e.colors))
+	opaque := true
+	for _, c := range e.colors {
+		plte = append(plte, uint8(c>>24), uint8(c>>16), uint8(c>>8))
+		trns = append(trns, uint8(c))
+		opaque = opaque && uint8(c) == 0xff
+	}
+	e.writeChunk(plte, "PLTE")
+	if !opaque {
+		e.writeChunk(trns, "tRNS")
+	}
+}
+
+// An idatWriter writes everything written to it as IDAT chunks.
+type idatWriter struct {
+	e *encoder
+}
+
+func (w idatWriter) Write(b []byte) (int, error) {
+	w.e.writeChunk(b, "IDAT")
+	if w.e.err != nil {
+		return 0, w.e.err
+	}
+	return len(b), nil
+}
+
+// Return a buffered writer of IDAT chunks.
+func newIDATBuffer(e *encoder) *bufio.Writer {
+	return bufio.NewWriterSize(idatWriter{e}, 1<<15)
+}
+
+// Return the number of bytes per complete pixel, as used by the filters.
+func (e *encoder) bytesPerPixel() int {
+	if e.bitDepth < 8 {
+		return 1
+	}
+	channels := 1
+	switch e.colorType {
+	case colorPaletted:
+		return 1
+	case colorGrayAlpha:
+		channels = 2
+	case colorRGB:
+		channels = 3
+	case colorRGBA:
+		channels = 4
+	}
+	return channels * e.bitDepth / 8
+}
+
+// Return the number of bytes of a raw scanline, excluding the filter type byte.
+func (e *encoder) rowLen() int {
+	if e.colorType == colorPaletted {
+		return e.width
+	}
+	if e.bitDepth == 1 {
+		return (e.width + 7) / 8
+	}
+	return e.width * e.bytesPerPixel()
+}
+
+// Fill row with the raw scanline y of the output buffer, relative to the top of the image.
+func (e *encoder) rawRow(row []byte, y int) {
+	pix := e.img.out.Pix[y*e.img.out.Stride:]
+	if e.bitDepth == 1 {
+		// Pack 8 pixels per byte, the leftmost one in the high bit.
+		for i := range row {
+			row[i] = 0
+		}
+		for x := 0; x < e.width; x++ {
+			if r, _, _, _ := readPixel(pix, x*8); r != 0 {
+				row[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		return
+	}
+	i := 0
+	for x := 0; x < e.width; x++ {
+		r, g, b, a := readPixel(pix, x*8)
+		if e.colorType == colorPaletted {
+			row[x] = uint8(e.palette[packNRGBA(r, g, b, a)])
+			continue
+		}
+		if e.colorType == colorRGBA || e.colorType == colorGrayAlpha {
+			r, g, b = unpremultiply(r, g, b, a)
+		}
+		var values [4]uint32
+		var channels []uint32
+		switch e.colorType {
+		case colorGray:
+			values[0] = r
+			channels = values[:1]
+		case colorGrayAlpha:
+			values[0], values[1] = r, a
+			channels = values[:2]
+		case colorRGB:
+			values[0], values[1], values[2] = r, g, b
+			channels = values[:3]
+		default:
+			values[0], values[1], values[2], values[3] = r, g, b, a
+			channels = values[:4]
+		}
+		for _, v := range channels {
+			if e.bitDepth == 8 {
+				row[i] = to8Bit(v)
+				i++
+			} else {
+				row[i], row[i+1] = uint8(v>>8), uint8(v)
+				i += 2
+			}
+		}
+	}
+}
+
+// Write the filtered scanlines as a zlib stream in IDAT chunks.
+func (e *encoder) writeIDATs() {
+	buf := newIDATBuffer(e)
+	zw, err := zlib.NewWriterLevel(buf, e.level)
+	if err != nil {
+		e.err = err
+		return
+	}
+	rowLen := e.rowLen()
+	prev := make([]byte, rowLen)
+	cur := make([]byte, rowLen)
+	filtered := make([][]byte, numFilters)
+	for f := range filtered {
+		filtered[f] = make([]byte, rowLen+1)
+	}
+	for y := 0; y < e.height; y++ {
+		e.rawRow(cur, y)
+		out := filterRow(filtered, cur, prev, e.bytesPerPixel(), e.level == zlib.NoCompression)
+		if _, err := zw.Write(out); err != nil {
+			e.err = err
+			return
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		e.err = err
+		return
+	}
+	if err := buf.Flush(); err != nil {
+		e.err = err
+	}
+}
+
+// Filter the scanline cur given the previous scanline prev, and return the filtered
+// scanline prefixed by its filter type. The filter with the smallest sum of absolute
+// differences is chosen, unless noFilter is set.
+func filterRow(filtered [][]byte, cur []byte, prev []byte, bpp int, noFilter bool) []byte {
+	none := filtered[filterNone]
+	none[0] = filterNone
+	copy(none[1:], cur)
+	if noFilter {
+		return none
+	}
+	best, bestSum := none, absSum(none[1:])
+	for f := filterSub; f < numFilters; f++ {
+		out := filtered[f]
+		out[0] = uint8(f)
+		for i := range cur {
+			var left, upLeft uint8
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch f {
+			case filterSub:
+				out[i+1] = cur[i] - left
+			case filterUp:
+				out[i+1] = cur[i] - up
+			case filterAverage:
+				out[i+1] = cur[i] - uint8((int(left)+int(up))/2)
+			case filterPaeth:
+				out[i+1] = cur[i] - paeth(left, up, upLeft)
+			}
+		}
+		if sum := absSum(out[1:]); sum < bestSum {
+			best, bestSum = out, sum
+		}
+	}
+	return best
+}
+
+// Return the sum of the filtered bytes interpreted as signed values.
+func absSum(b []byte) int {
+	sum := 0
+	for _, v := range b {
+		if v < 128 {
+			sum += int(v)
+		} else {
+			sum += 256 - int(v)
+		}
+	}
+	return sum
+}
+
+// The Paeth predictor of the PNG specification.
+func paeth(a uint8, b uint8, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,94 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEqualizeMapping(t *testing.T) {
+	// A flat histogram is already equalized.
+	flat := make([]uint64, histLevels)
+	for i := range flat {
+		flat[i] = 10
+	}
+	for i, v := range equalizeMapping(flat, 0) {
+		if absDiff(uint32(v), uint32(i*0x101)) > 0x101 {
+			t.Fatalf("FAILED: flat histogram maps level %v to %v", i, v)
+		}
+	}
+	// Without a limit, two levels map to black and white. A clip limit lowers the gain.
+	two := make([]uint64, histLevels)
+	two[100], two[110] = 50, 50
+	if lut := equalizeMapping(two, 0); lut[100] != 0 || lut[110] != 0xffff {
+		t.Errorf("FAILED: two levels map to %v and %v", lut[100], lut[110])
+	}
+	if lut := equalizeMapping(two, 2); lut[110]-lut[100] >= 0x8000 {
+		t.Errorf("FAILED: clipped levels map to %v and %v", lut[100], lut[110])
+	}
+}
+
+func TestEqualizeStretchesContrast(t *testing.T) {
+	// A dim gradient over a quarter of the range.
+	img := newStepImage(64, 8, func(x int, y int) uint16 { return uint16(0x4000 + x*0x100) })
+	effect, _ := NewEffect("equalize", nil)
+	effect.Apply(img, 0, 64*8)
+	first, _, _, _ := readPixel(img.out.Pix, img.out.PixOffset(0, 3))
+	last, _, _, _ := readPixel(img.out.Pix, img.out.PixOffset(63, 3))
+	if first > 0x800 || last != 0xffff {
+		t.Errorf("FAILED: equalized gradient spans %v to %v", first, last)
+	}
+	prev := uint32(0)
+	for x := 0; x < 64; x++ {
+		v, _, _, _ := readPixel(img.out.Pix, img.out.PixOffset(x, 5))
+		if v < prev {
+			t.Fatalf("FAILED: equalized gradient decreases at %v", x)
+		}
+		prev = v
+	}
+}
+
+func TestEqualizeStages(t *testing.T) {
+	// Two halves lit differently.
+	scene := func(x int, y int) uint16 {
+		if x < 20 {
+			return uint16(0x1000 + (x*7+y*3)%16*0x100)
+		}
+		return uint16(0xa000 + (x*5+y*11)%32*0x180)
+	}
+	for _, name := range []string{"equalize", "clahe"} {
+		effect, _ := NewEffect(name, map[string]any{})
+		if name == "clahe" {
+			effect, _ = NewEffect(name, map[string]any{"tiles": 3, "clip": 3})
+		}
+		expected := newStepImage(41, 29, scene)
+		effect.Apply(expected, 0, 41*29)
+		for _, chunk := range []int{1, 50, 41 * 29} {
+			img := newStepImage(41, 29, scene)
+			applyStages(img, effect, chunk)
+			if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+				t.Errorf("FAILED: %v stages differ with chunks of %v pixels", name, chunk)
+			}
+		}
+	}
+}
+
+func TestCLAHEEqualizesTiles(t *testing.T) {
+	// The dark half gets spread by its own tiles, unlike a global equalization
+	// which keeps it below the bright half.
+	scene := func(x int, y int) uint16 {
+		if x < 32 {
+			return uint16(0x1000 + (x%8)*0x200)
+		}
+		return uint16(0xc000 + (x%8)*0x200)
+	}
+	effect, _ := NewEffect("clahe", map[string]any{"tiles": 2, "clip": 64})
+	img := newStepImage(64, 32, scene)
+	effect.Apply(img, 0, 64*32)
+	v, _, _, _ := readPixel(img.out.Pix, img.out.PixOffset(7, 16))
+	if v < 0xc000 {
+		t.Errorf("FAILED: brightest level of the dark tiles maps to %v", v)
+	}
+	if _, err := NewEffect("clahe", map[string]any{"clip": 0.5}); err == nil {
+		t.Errorf("FAILED: clip limit below 1 accepted")
+	}
+}
@@ -0,0 +1,111 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"math"
+)
+
+// The largest standard deviation of the gaussian blur.
+const maxGaussianSigma = 100
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "gaussian", Params: []string{"border", "sigma"}, New: newGaussianEffect})
+}
+
+// A gaussianEffect blurs the image with a gaussian kernel, as a horizontal pass followed by a vertical pass.
+type gaussianEffect struct {
+	sigma   float64
+	border  Border
+	weights []float64 // The one-dimensional kernel of both passes
+}
+
+// A passEffect is one pass of a separable kernel, along the rows or along the columns.
+type passEffect struct {
+	parent     Effect
+	weights    []float64
+	horizontal bool
+	border     Border
+}
+
+// Create a gaussian blur with the standard deviation given by the "sigma" parameter.
+// The kernel covers 3 sigma on each side of a pixel.
+func newGaussianEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := params["sigma"]; !ok {
+		return nil, errors.New("png: effect \"gaussian\" needs a sigma")
+	}
+	sigma, err := paramFloat(params, "sigma", 0, 0, maxGaussianSigma)
+	if err != nil {
+		return nil, err
+	}
+	if sigma == 0 {
+		return nil, errors.New("png: gaussian sigma must be positive")
+	}
+	return &gaussianEffect{sigma: sigma, border: border, weights: gaussianWeights(sigma)}, nil
+}
+
+// Return the normalized one-dimensional gaussian kernel of standard deviation sigma.
+func gaussianWeights(sigma float64) []float64 {
+	return gaussianWindow(sigma, int(math.Ceil(3*sigma)))
+}
+
+// Return the normalized one-dimensional gaussian kernel of standard deviation sigma,
+// truncated to the given radius.
+func gaussianWindow(sigma float64, radius int) []float64 {
+	weights := make([]float64, 2*radius+1)
+	total := float64(0)
+	for i := range weights {
+		x := float64(i - radius)
+		weights[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		total += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= total
+	}
+	return weights
+}
+
+func (e *gaussianEffect) Name() string { return "gaussian" }
+
+func (e *gaussianEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "sigma": e.sigma}
+}
+
+func (e *gaussianEffect) Radius() int { return len(e.weights) / 2 }
+
+// Apply both passes to the image slice at once, through the separable kernel.
+func (e *gaussianEffect) Apply(img *Image, start int, end int) {
+	img.PerformKernel(&Kernel{Size: len(e.weights), Row: e.weights, Col: e.weights}, e.border, start, end)
+}
+
+func (e *gaussianEffect) ApplyLinear(img *Image, start int, end int) {
+	img.performKernelLinear(&Kernel{Size: len(e.weights), Row: e.weights, Col: e.weights}, e.border, start, end)
+}
+
+func (e *gaussianEffect) Stages(img *Image) []Effect {
+	return []Effect{
+		&passEffect{parent: e, weights: e.weights, horizontal: true, border: e.border},
+		&passEffect{parent: e, weights: e.weights, horizontal: false, border: e.border},
+	}
+}
+
+func (e *passEffect) Name() string { return e.parent.Name() }
+
+func (e *passEffect) Params() map[string]any {
+	return e.parent.Params()
+}
+
+func (e *passEffect) Radius() int { return len(e.weights) / 2 }
+
+func (e *passEffect) Apply(img *Image, start int, end int) {
+	img.performPass(e.weights, e.horizontal, e.border, start, end)
+}
+
+func (e *passEffect) ApplyLinear(img *Image, start int, end int) {
+	img.performPassLinear(e.weights, e.horizontal, e.border, start, end)
+}
@@ -0,0 +1,76 @@
+package png
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestGaussianParams(t *testing.T) {
+	if _, err := NewEffect("gaussian", nil); err == nil {
+		t.Errorf("FAILED: gaussian without sigma should be rejected")
+	}
+	if _, err := NewEffect("gaussian", map[string]any{"sigma": 0.0}); err == nil {
+		t.Errorf("FAILED: zero sigma should be rejected")
+	}
+	effect, err := NewEffect("gaussian", map[string]any{"sigma": 1.5})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if effect.Radius() != 5 || len(Stages(effect, nil)) != 2 {
+		t.Errorf("FAILED: gaussian of sigma 1.5 has radius %v and %v stages", effect.Radius(), len(Stages(effect, nil)))
+	}
+	if total := sum(gaussianWeights(1.5)); math.Abs(total-1) > 1e-12 {
+		t.Errorf("FAILED: gaussian weights sum to %v", total)
+	}
+}
+
+// Apply the stages of the effect in chunks of the given size, each one by a goroutine,
+// with a Swap after each stage.
+func applyStages(img *Image, effect Effect, chunk int) {
+	img.AllocatePlanes(effect)
+	defer img.ReleasePlanes()
+	for _, stage := range Stages(effect, img) {
+		numPixels := img.Prepare(stage)
+		var wg sync.WaitGroup
+		for start := 0; start < numPixels; start += chunk {
+			end := start + chunk
+			if end > numPixels {
+				end = numPixels
+			}
+			wg.Add(1)
+			go func(start int, end int) {
+				defer wg.Done()
+				stage.Apply(img, start, end)
+			}(start, end)
+		}
+		wg.Wait()
+		img.Swap()
+	}
+	img.Swap()
+}
+
+func TestGaussianStages(t *testing.T) {
+	for _, border := range []string{"zero", "clamp", "mirror", "wrap", "renormalize"} {
+		effect, _ := NewEffect("gaussian", map[string]any{"sigma": 1.2, "border": border})
+		expected := newTestImage(23, 17)
+		applyStages(expected, effect, 23*17)
+		img := newTestImage(23, 17)
+		applyStages(img, effect, 37)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: %v gaussian stages differ when chunked", border)
+		}
+
+		// The passes match the separable kernel, up to the rounding between the passes.
+		whole := newTestImage(23, 17)
+		effect.Apply(whole, 0, 23*17)
+		for i := 0; i < len(img.out.Pix); i += 8 {
+			r1, g1, b1, a1 := readPixel(img.out.Pix, i)
+			r2, g2, b2, a2 := readPixel(whole.out.Pix, i)
+			if absDiff(r1, r2) > 2 || absDiff(g1, g2) > 2 || absDiff(b1, b2) > 2 || a1 != a2 {
+				t.Fatalf("FAILED: %v gaussian pixel %v is %v,%v,%v,%v, expected %v,%v,%v,%v", border, i/8, r1, g1, b1, a1, r2, g2, b2, a2)
+			}
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// The largest width or height of a resized or cropped image, and the largest resize scale.
+const (
+	maxImageSize   = 1 << 15
+	maxResizeScale = 32
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "resize", Params: []string{"width", "height", "scale", "filter"}, New: newResizeEffect})
+	RegisterEffect(EffectSpec{Name: "rotate", Params: []string{"border", "degrees", "filter", "expand"}, New: newRotateEffect})
+	RegisterEffect(EffectSpec{Name: "flip", Params: []string{"direction"}, New: newFlipEffect})
+	RegisterEffect(EffectSpec{Name: "crop", Params: []string{"x", "y", "width", "height"}, New: newCropEffect})
+}
+
+// A resizeEffect scales the image to a new width and height with an interpolation filter.
+type resizeEffect struct {
+	width, height int     // The output size, 0 to keep the aspect ratio of the other one
+	scale         float64 // The scale of both sides, 0 if the size is given
+	filter        *filter
+}
+
+// Create a resize effect to the given "width" and "height", where a missing one keeps the aspect ratio,
+// or by the "scale" of both sides. The "filter" is "nearest", "bilinear", the default, "bicubic" or "lanczos".
+func newResizeEffect(params map[string]any) (Effect, error) {
+	e := &resizeEffect{}
+	var err error
+	if e.width, err = paramInt(params, "width", 0, 1, maxImageSize); err != nil {
+		return nil, err
+	}
+	if e.height, err = paramInt(params, "height", 0, 1, maxImageSize); err != nil {
+		return nil, err
+	}
+	if e.scale, err = paramFloat(params, "scale", 0, 1.0/maxResizeScale, maxResizeScale); err != nil {
+		return nil, err
+	}
+	if (e.scale == 0) == (e.width == 0 && e.height == 0) {
+		return nil, errors.New("png: resize needs either a width and height or a scale")
+	}
+	if e.filter, err = paramFilter(params, "filter"); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *resizeEffect) Name() string { return "resize" }
+
+func (e *resizeEffect) Params() map[string]any {
+	params := map[string]any{"filter": e.filter.name}
+	if e.width != 0 {
+		params["width"] = e.width
+	}
+	if e.height != 0 {
+		params["height"] = e.height
+	}
+	if e.scale != 0 {
+		params["scale"] = e.scale
+	}
+	return params
+}
+
+// A resized pixel may read any pixel of the input.
+func (e *resizeEffect) Radius() int { return math.MaxInt32 }
+
+func (e *resizeEffect) OutputBounds(in image.Rectangle) image.Rectangle {
+	w, h := e.width, e.height
+	switch {
+	case e.scale != 0:
+		w, h = scaledSize(in.Dx(), e.scale), scaledSize(in.Dy(), e.scale)
+	case w == 0:
+		w = scaledSize(in.Dx(), float64(h)/float64(in.Dy()))
+	case h == 0:
+		h = scaledSize(in.Dy(), float64(w)/float64(in.Dx()))
+	}
+	return image.Rect(0, 0, w, h)
+}
+
+// Return the side scaled and rounded to the nearest, at least 1 and at most maxImageSize.
+func scaledSize(side int, scale float64) int {
+	return clip(int(math.Round(float64(side)*scale)), 1, maxImageSize)
+}
+
+func (e *resizeEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *resizeEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Resize the image slice, in the float planes if linear.
+func (e *resizeEffect) apply(img *Image, start int, end int, linear bool) {
+	in := img.in.Bounds()
+	scaleX := float64(in.Dx()) / float64(img.out.Bounds().Dx())
+	scaleY := float64(in.Dy()) / float64(img.out.Bounds().Dy())
+	img.resample(e.filter, BorderClamp, scaleX, scaleY, linear, start, end, func(x float64, y float64) (float64, float64, bool) {
+		return float64(in.Min.X) + (x+0.5)*scaleX, float64(in.Min.Y) + (y+0.5)*scaleY, true
+	})
+}
+
+// A rotateEffect turns the image counterclockwise about its center, with an interpolation filter.
+// The pixels of an expanded output that fall outside of the input are read by the border policy.
+type rotateEffect struct {
+	degrees float64
+	border  Border
+	filter  *filter
+	expand  bool // Enlarge the output to hold the whole rotated input, or keep the input size
+}
+
+// Create a rotation by "degrees" counterclockwise, with the "filter" of a resize, bilinear by default.
+// With "expand", the default, the output is enlarged to hold the whole rotated image.
+// The corners are read by the border policy, transparent with the zero border.
+func newRotateEffect(params map[string]any) (Effect, error) {
+	e := &rotateEffect{expand: true}
+	var err error
+	if e.border, err = paramBorder(params, "border"); err != nil {
+		return nil, err
+	}
+	if e.degrees, err = paramFloat(params, "degrees", 0, -360, 360); err != nil {
+		return nil, err
+	}
+	if e.filter, err = paramFilter(params, "filter"); err != nil {
+		return nil, err
+	}
+	if v, ok := params["expand"]; ok {
+		if e.expand, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("png: parameter %q must be a boolean, got %v", "expand", v)
+		}
+	}
+	return e, nil
+}
+
+func (e *rotateEffect) Name() string { return "rotate" }
+
+func (e *rotateEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "degrees": e.degrees, "filter": e.filter.name, "expand": e.expand}
+}
+
+// A rotated pixel may read any pixel of the input.
+func (e *rotateEffect) Radius() int { return math.MaxInt32 }
+
+// Return the sine and cosine of the rotation, exact for multiples of 90 degrees.
+func (e *rotateEffect) sinCos() (float64, float64) {
+	if math.Mod(e.degrees, 90) == 0 {
+		quarter := int(e.degrees/90+4) % 4
+		return []float64{0, 1, 0, -1}[quarter], []float64{1, 0, -1, 0}[quarter]
+	}
+	return math.Sincos(e.degrees * math.Pi / 180)
+}
+
+func (e *rotateEffect) OutputBounds(in image.Rectangle) image.Rectangle {
+	if !e.expand {
+		return image.Rect(0, 0, in.Dx(), in.Dy())
+	}
+	sin, cos := e.sinCos()
+	w, h := float64(in.Dx()), float64(in.Dy())
+	// Round away the floating point error before rounding up.
+	size := func(v float64) int { return clip(int(math.Ceil(v-1e-9)), 1, maxImageSize) }
+	return image.Rect(0, 0, size(w*math.Abs(cos)+h*math.Abs(sin)), size(w*math.Abs(sin)+h*math.Abs(cos)))
+}
+
+func (e *rotateEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *rotateEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Rotate the image slice, in the float planes if linear.
+func (e *rotateEffect) apply(img *Image, start int, end int, linear bool) {
+	in := img.in.Bounds()
+	out := img.out.Bounds()
+	sin, cos := e.sinCos()
+	// The position in the input of each output pixel, turned clockwise about the centers,
+	// where y grows downwards.
+	cx, cy := float64(in.Min.X)+float64(in.Dx())/2, float64(in.Min.Y)+float64(in.Dy())/2
+	ox, oy := float64(out.Dx())/2, float64(out.Dy())/2
+	img.resample(e.filter, e.border, 1, 1, linear, start, end, func(x float64, y float64) (float64, float64, bool) {
+		dx, dy := x+0.5-ox, y+0.5-oy
+		return cx + dx*cos - dy*sin, cy + dx*sin + dy*cos, true
+	})
+}
+
+// A flipEffect mirrors the image horizontally, left to right, or vertically, top to bottom.
+type flipEffect struct {
+	direction string
+}
+
+// Create a flip in the "direction" "horizontal", the default, "vertical" or "both".
+func newFlipEffect(params map[string]any) (Effect, error) {
+	e := &flipEffect{direction: "horizontal"}
+	if v, ok := params["direction"]; ok {
+		if e.direction, ok = v.(string); !ok {
+			return nil, fmt.Errorf("png: parameter %q must be a string, got %v", "direction", v)
+		}
+	}
+	switch e.direction {
+	case "horizontal", "vertical", "both":
+		return e, nil
+	}
+	return nil, fmt.Errorf("png: unknown flip direction %q", e.direction)
+}
+
+func (e *flipEffect) Name() string { return "flip" }
+
+func (e *flipEffect) Params() map[string]any {
+	return map[string]any{"direction": e.direction}
+}
+
+// A flipped pixel reads the opposite side of the image.
+func (e *flipEffect) Radius() int { return math.MaxInt32 }
+
+func (e *flipEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *flipEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Flip the image slice, in the float planes if linear.
+func (e *flipEffect) apply(img *Image, start int, end int, linear bool) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n, h := xMax-xMin, yMax-yMin
+	for k := start; k < end; k++ {
+		x, y := k%n, k/n
+		if e.direction != "vertical" {
+			x = n - 1 - x
+		}
+		if e.direction != "horizontal" {
+			y = h - 1 - y
+		}
+		if linear {
+			i := y*img.fin.Stride + x*4
+			copy(img.fout.Pix[floatOffset(k, n, img.fout.Stride):], img.fin.Pix[i:i+4])
+			continue
+		}
+		i := y*img.in.Stride + x*8
+		copy(img.out.Pix[pixOffset(k, n, img.out.Stride):], img.in.Pix[i:i+8])
+	}
+}
+
+// A cropEffect keeps a rectangle of the image, clipped to the image bounds.
+type cropEffect struct {
+	rect image.Rectangle // The kept rectangle, relative to the top left corner of the image
+}
+
+// Create a crop to the rectangle of the given "width" and "height" whose top left corner is at
+// "x" and "y", 0 by default.
+func newCropEffect(params map[string]any) (Effect, error) {
+	x, err := paramInt(params, "x", 0, 0, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	y, err := paramInt(params, "y", 0, 0, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	w, err := paramInt(params, "width", 0, 1, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	h, err := paramInt(params, "height", 0, 1, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	if w == 0 || h == 0 {
+		return nil, errors.New("png: crop needs a width and a height")
+	}
+	return &cropEffect{rect: image.Rect(x, y, x+w, y+h)}, nil
+}
+
+func (e *cropEffect) Name() string { return "crop" }
+
+func (e *cropEffect) Params() map[string]any {
+	return map[string]any{"x": e.rect.Min.X, "y": e.rect.Min.Y, "width": e.rect.Dx(), "height": e.rect.Dy()}
+}
+
+func (e *cropEffect) Radius() int { return 0 }
+
+// The rectangle must overlap the image, which is reported by Check.
+func (e *cropEffect) Check(img *Image) error {
+	in := img.in.Bounds()
+	if e.rect.Add(in.Min).Intersect(in).Empty() {
+		return fmt.Errorf("png: crop rectangle %v lies outside of the %vx%v image", e.rect, in.Dx(), in.Dy())
+	}
+	return nil
+}
+
+// The output is empty if the rectangle lies outside of the image.
+func (e *cropEffect) OutputBounds(in image.Rectangle) image.Rectangle {
+	kept := e.rect.Add(in.Min).Intersect(in)
+	return image.Rect(0, 0, kept.Dx(), kept.Dy())
+}
+
+func (e *cropEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *cropEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Crop the image slice, in the float planes if linear.
+func (e *cropEffect) apply(img *Image, start int, end int, linear bool) {
+	n := img.out.Bounds().Dx()
+	if n == 0 {
+		return
+	}
+	for k := start; k < end; k++ {
+		x, y := e.rect.Min.X+k%n, e.rect.Min.Y+k/n
+		if linear {
+			i := y*img.fin.Stride + x*4
+			copy(img.fout.Pix[floatOffset(k, n, img.fout.Stride):], img.fin.Pix[i:i+4])
+			continue
+		}
+		i := y*img.in.Stride + x*8
+		copy(img.out.Pix[pixOffset(k, n, img.out.Stride):], img.in.Pix[i:i+8])
+	}
+}
@@ -0,0 +1,200 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// Return the pixel (x, y) of the output buffer.
+func outPixel(img *Image, x int, y int) [4]uint32 {
+	r, g, b, a := readPixel(img.out.Pix, img.out.PixOffset(x, y))
+	return [4]uint32{r, g, b, a}
+}
+
+// Return the pixel (x, y) of the input buffer.
+func inPixel(img *Image, x int, y int) [4]uint32 {
+	r, g, b, a := readPixel(img.in.Pix, img.in.PixOffset(x, y))
+	return [4]uint32{r, g, b, a}
+}
+
+func TestResize(t *testing.T) {
+	// Resampling to the same size is the identity with every filter.
+	for _, filter := range []string{"nearest", "bilinear", "bicubic", "lanczos"} {
+		effect, err := NewEffect("resize", map[string]any{"width": 13, "height": 9, "filter": filter})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newTestImage(13, 9)
+		original := append([]byte(nil), img.in.Pix...)
+		applyStages(img, effect, 20)
+		if !bytes.Equal(img.out.Pix, original) {
+			t.Errorf("FAILED: %v resize to the same size changes the image", filter)
+		}
+	}
+
+	// Doubling with the nearest filter repeats each pixel.
+	effect, _ := NewEffect("resize", map[string]any{"scale": 2, "filter": "nearest"})
+	img := newTestImage(7, 5)
+	applyStages(img, effect, 11)
+	if img.Bounds != image.Rect(0, 0, 14, 10) || img.out.Bounds() != img.Bounds {
+		t.Fatalf("FAILED: doubled image has bounds %v and output %v", img.Bounds, img.out.Bounds())
+	}
+	source := newTestImage(7, 5)
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 14; x++ {
+			if outPixel(img, x, y) != inPixel(source, x/2, y/2) {
+				t.Fatalf("FAILED: doubled pixel (%v, %v) is %v", x, y, outPixel(img, x, y))
+			}
+		}
+	}
+
+	// Halving a checkerboard averages it to gray away from the clamped edges,
+	// with the width keeping the aspect ratio.
+	effect, _ = NewEffect("resize", map[string]any{"width": 8})
+	img = newStepImage(16, 12, func(x int, y int) uint16 { return uint16((x + y) % 2 * 0xffff) })
+	applyStages(img, effect, 16)
+	if img.Bounds != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("FAILED: halved image has bounds %v", img.Bounds)
+	}
+	for y := 1; y < 5; y++ {
+		for x := 1; x < 7; x++ {
+			if p := outPixel(img, x, y); absDiff(p[0], 0x8000) > 1 || p[3] != 0xffff {
+				t.Fatalf("FAILED: halved checkerboard pixel (%v, %v) is %v", x, y, p)
+			}
+		}
+	}
+
+	invalid := []map[string]any{{}, {"scale": 2, "width": 4}, {"width": 0}, {"width": 4, "filter": "cubic"}}
+	for _, params := range invalid {
+		if _, err := NewEffect("resize", params); err == nil {
+			t.Errorf("FAILED: resize with %v should be rejected", params)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	// A quarter turn counterclockwise moves the right column to the top row.
+	effect, _ := NewEffect("rotate", map[string]any{"degrees": 90, "filter": "bicubic"})
+	source := newTestImage(7, 4)
+	img := newTestImage(7, 4)
+	applyStages(img, effect, 5)
+	if img.Bounds != image.Rect(0, 0, 4, 7) {
+		t.Fatalf("FAILED: rotated image has bounds %v", img.Bounds)
+	}
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 4; x++ {
+			if outPixel(img, x, y) != inPixel(source, 6-y, x) {
+				t.Fatalf("FAILED: rotated pixel (%v, %v) is %v, expected %v", x, y, outPixel(img, x, y), inPixel(source, 6-y, x))
+			}
+		}
+	}
+
+	// Any rotation is independent of the slicing, and the corners of an expanded image are transparent.
+	effect, _ = NewEffect("rotate", map[string]any{"degrees": -30})
+	expected := newTestImage(15, 11)
+	applyStages(expected, effect, 1000)
+	if b := expected.Bounds; b.Dx() != 19 || b.Dy() != 18 {
+		t.Errorf("FAILED: image rotated by 30 degrees has bounds %v", b)
+	}
+	if p := outPixel(expected, 0, 0); p != [4]uint32{} {
+		t.Errorf("FAILED: corner of the rotated image is %v", p)
+	}
+	img = newTestImage(15, 11)
+	applyStages(img, effect, 23)
+	if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+		t.Errorf("FAILED: rotation differs when chunked")
+	}
+
+	// Without expanding, the size is kept.
+	effect, _ = NewEffect("rotate", map[string]any{"degrees": 45, "expand": false, "border": "clamp"})
+	img = newTestImage(15, 11)
+	applyStages(img, effect, 23)
+	if img.Bounds != image.Rect(0, 0, 15, 11) {
+		t.Errorf("FAILED: rotation without expanding has bounds %v", img.Bounds)
+	}
+}
+
+func TestFlipAndCrop(t *testing.T) {
+	source := newTestImage(9, 6)
+	for _, direction := range []string{"horizontal", "vertical", "both"} {
+		effect, _ := NewEffect("flip", map[string]any{"direction": direction})
+		img := newTestImage(9, 6)
+		applyStages(img, effect, 7)
+		for y := 0; y < 6; y++ {
+			for x := 0; x < 9; x++ {
+				xx, yy := x, y
+				if direction != "vertical" {
+					xx = 8 - x
+				}
+				if direction != "horizontal" {
+					yy = 5 - y
+				}
+				if outPixel(img, x, y) != inPixel(source, xx, yy) {
+					t.Fatalf("FAILED: %v flipped pixel (%v, %v) is %v", direction, x, y, outPixel(img, x, y))
+				}
+			}
+		}
+	}
+
+	// The crop rectangle is clipped to the image.
+	effect, _ := NewEffect("crop", map[string]any{"x": 5, "y": 2, "width": 10, "height": 3})
+	img := newTestImage(9, 6)
+	applyStages(img, effect, 4)
+	if img.Bounds != image.Rect(0, 0, 4, 3) {
+		t.Fatalf("FAILED: cropped image has bounds %v", img.Bounds)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			if outPixel(img, x, y) != inPixel(source, x+5, y+2) {
+				t.Fatalf("FAILED: cropped pixel (%v, %v) is %v", x, y, outPixel(img, x, y))
+			}
+		}
+	}
+	if _, err := NewEffect("crop", map[string]any{"width": 3}); err == nil {
+		t.Errorf("FAILED: crop without a height should be rejected")
+	}
+	if err := CheckEffect(effect, newTestImage(9, 6)); err != nil {
+		t.Errorf("FAILED: crop overlapping the image should apply: %v", err)
+	}
+	// A rectangle outside of the image would leave it empty.
+	outside, _ := NewEffect("crop", map[string]any{"x": 9, "y": 0, "width": 10, "height": 3})
+	if err := CheckEffect(outside, newTestImage(9, 6)); err == nil {
+		t.Errorf("FAILED: crop outside of the image should be rejected")
+	}
+}
+
+func TestGeometryChain(t *testing.T) {
+	// The buffers follow the bounds through a chain of effects, reusing the pool.
+	pool := NewPool()
+	img := newTestImage(12, 8)
+	img.pool = pool
+	for _, name := range []string{"crop", "blur", "rotate", "canny", "resize"} {
+		params := map[string]any{}
+		switch name {
+		case "crop":
+			params = map[string]any{"x": 1, "y": 1, "width": 10, "height": 5}
+		case "rotate":
+			params = map[string]any{"degrees": 90}
+		case "resize":
+			params = map[string]any{"scale": 1.5}
+		}
+		effect, err := NewEffect(name, params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		for _, stage := range Stages(effect, img) {
+			stage.Apply(img, 0, img.Prepare(stage))
+			img.Swap()
+		}
+		if img.in.Bounds() != img.Bounds || img.out.Bounds() != img.Bounds {
+			t.Fatalf("FAILED: after %v the buffers have bounds %v and %v, the image %v", name, img.in.Bounds(), img.out.Bounds(), img.Bounds)
+		}
+	}
+	if img.Bounds != image.Rect(0, 0, 8, 15) {
+		t.Errorf("FAILED: chained image has bounds %v", img.Bounds)
+	}
+	if stats := pool.Stats(); stats.Reused == 0 {
+		t.Errorf("FAILED: no buffer reused, %+v", stats)
+	}
+}
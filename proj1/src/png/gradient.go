@@ -0,0 +1,111 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import "math"
+
+// The horizontal kernels of the gradient operators, the vertical ones are their transposes.
+var (
+	sobelKernel   = &Kernel{Size: 3, Weights: []float64{-1, 0, 1, -2, 0, 2, -1, 0, 1}}
+	prewittKernel = &Kernel{Size: 3, Weights: []float64{-1, 0, 1, -1, 0, 1, -1, 0, 1}}
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "sobel", Params: []string{"border"}, New: newGradientEffect("sobel", sobelKernel)})
+	RegisterEffect(EffectSpec{Name: "prewitt", Params: []string{"border"}, New: newGradientEffect("prewitt", prewittKernel)})
+}
+
+// A gradientEffect writes the gradient magnitude of each channel, from the
+// convolutions with a horizontal kernel and with its transpose.
+type gradientEffect struct {
+	name   string
+	kx, ky *Kernel
+	border Border
+}
+
+// Return the factory of the gradient effect with the given horizontal kernel.
+func newGradientEffect(name string, kernel *Kernel) func(params map[string]any) (Effect, error) {
+	return func(params map[string]any) (Effect, error) {
+		border, err := paramBorder(params, "border")
+		if err != nil {
+			return nil, err
+		}
+		return &gradientEffect{name: name, kx: kernel, ky: kernel.transpose(), border: border}, nil
+	}
+}
+
+func (e *gradientEffect) Name() string { return e.name }
+
+func (e *gradientEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String()}
+}
+
+func (e *gradientEffect) Radius() int { return e.kx.Radius() }
+
+func (e *gradientEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *gradientEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Write the gradient magnitudes of the image slice, in the float planes if linear.
+func (e *gradientEffect) apply(img *Image, start int, end int, linear bool) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := e.kx.Radius()
+	stride, step := img.inputLayout(linear)
+
+	// Pix offsets of the neighbouring rows and columns of a pixel, -1 if the neighbour is skipped.
+	rowOffs := make([]int, e.kx.Size)
+	colOffs := make([]int, e.kx.Size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			e.border.offsets(rowOffs, y-radius, yMin, yMax, stride)
+		}
+		e.border.offsets(colOffs, x-radius, xMin, xMax, step)
+
+		var gx, gy [3]float64
+		kIndex := 0
+		for _, rowOff := range rowOffs {
+			for _, colOff := range colOffs {
+				if rowOff >= 0 && colOff >= 0 {
+					r, g, b, _ := img.readInput(rowOff+colOff, linear)
+					wx, wy := e.kx.Weights[kIndex], e.ky.Weights[kIndex]
+					gx[0] += r * wx
+					gx[1] += g * wx
+					gx[2] += b * wx
+					gy[0] += r * wy
+					gy[1] += g * wy
+					gy[2] += b * wy
+				}
+				kIndex += 1
+			}
+		}
+		// The alpha channel is copied from the center pixel, which a premultiplied channel cannot exceed.
+		_, _, _, a := img.readInput((k/n)*stride+(k%n)*step, linear)
+		var rgb [3]float64
+		for c := range rgb {
+			rgb[c] = math.Min(math.Hypot(gx[c], gy[c]), a)
+		}
+		if linear {
+			writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride), clampFloat(rgb[0]), clampFloat(rgb[1]), clampFloat(rgb[2]), a)
+			continue
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), clamp(rgb[0]), clamp(rgb[1]), clamp(rgb[2]), uint16(a))
+	}
+}
+
+// Return the transposed kernel of a square kernel.
+func (k *Kernel) transpose() *Kernel {
+	weights := make([]float64, len(k.Weights))
+	for i := 0; i < k.Size; i++ {
+		for j := 0; j < k.Size; j++ {
+			weights[j*k.Size+i] = k.Weights[i*k.Size+j]
+		}
+	}
+	return &Kernel{Size: k.Size, Weights: weights}
+}
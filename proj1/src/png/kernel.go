@@ -0,0 +1,583 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// A Kernel is an odd-sized square convolution matrix.
+// A separable kernel is stored as its row and column factors instead of the full matrix,
+// and is performed as a horizontal pass followed by a vertical pass.
+// The convolution sums are divided by the divisor and offset by the bias, and the channels
+// the kernel does not apply to are copied from the center pixel.
+// The colors are premultiplied, so the alpha channel of a weighted average, e.g. a blur, is averaged
+// with them, and transparent neighbours do not darken the edges. Otherwise, e.g. for an edge detector,
+// the alpha channel is copied from the center pixel.
+type Kernel struct {
+	Size     int       // The width and height of the kernel
+	Weights  []float64 // Size*Size weights in row-major order, nil for a separable kernel
+	Row      []float64 // The horizontal factor of a separable kernel
+	Col      []float64 // The vertical factor of a separable kernel
+	Divisor  float64   // The divisor of the sums, 1 if 0
+	Bias     float64   // The offset of the sums as a fraction of the largest value, scaled by alpha
+	Channels string    // The rgb channels the kernel applies to, e.g. "rg", all of them if empty
+}
+
+// NewKernel returns a size x size kernel with the given row-major weights.
+func NewKernel(size int, weights []float64) (*Kernel, error) {
+	if size < 1 || size%2 == 0 {
+		return nil, errors.New("png: kernel size must be a positive odd number")
+	}
+	if len(weights) != size*size {
+		return nil, errors.New("png: kernel weights do not match the kernel size")
+	}
+	return &Kernel{Size: size, Weights: weights}, nil
+}
+
+// NewSeparableKernel returns the kernel whose matrix is the outer product of col and row.
+func NewSeparableKernel(row []float64, col []float64) (*Kernel, error) {
+	if len(row) < 1 || len(row)%2 == 0 {
+		return nil, errors.New("png: kernel size must be a positive odd number")
+	}
+	if len(row) != len(col) {
+		return nil, errors.New("png: separable kernel factors differ in size")
+	}
+	return &Kernel{Size: len(row), Row: row, Col: col}, nil
+}
+
+// Radius returns the number of neighbours the kernel reads on each side of a pixel.
+func (k *Kernel) Radius() int {
+	return k.Size / 2
+}
+
+// Separable reports whether the kernel is performed as two one-dimensional passes.
+func (k *Kernel) Separable() bool {
+	return k.Weights == nil
+}
+
+// Report whether the kernel is a weighted average, whose alpha channel is averaged with the colors.
+// Its weights are non-negative and sum to the divisor, and it applies to all the channels.
+func (k *Kernel) averages() bool {
+	if k.Channels != "" {
+		for _, c := range "rgb" {
+			if !strings.ContainsRune(k.Channels, c) {
+				return false
+			}
+		}
+	}
+	divisor := k.Divisor
+	if divisor == 0 {
+		divisor = 1
+	}
+	if !nonNegative(k.Weights) || !nonNegative(k.Row) || !nonNegative(k.Col) {
+		return false
+	}
+	return math.Abs(k.Sum()-divisor) < 1e-9*divisor
+}
+
+// Report whether none of the weights is negative.
+func nonNegative(weights []float64) bool {
+	for _, w := range weights {
+		if w < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the output channels of the pixel at offset i of the input buffer from its convolution sums.
+// The alpha sum is the output alpha if blend is set, rounded so that an opaque image stays opaque,
+// and the alpha of the pixel is kept otherwise. A premultiplied channel cannot exceed alpha.
+func (k *Kernel) finish(inPix []uint8, i int, rNew float64, gNew float64, bNew float64, aNew float64, blend bool) (uint16, uint16, uint16, uint16) {
+	r, g, b, a := readPixel(inPix, i)
+	if blend {
+		if k.Divisor != 0 {
+			aNew /= k.Divisor
+		}
+		a = uint32(clamp(math.Round(aNew)))
+	}
+	af := float64(a)
+	if k.Divisor == 0 && k.Bias == 0 && k.Channels == "" {
+		return clamp(math.Min(rNew, af)), clamp(math.Min(gNew, af)), clamp(math.Min(bNew, af)), uint16(a)
+	}
+	sums := [3]float64{rNew, gNew, bNew}
+	out := [3]uint16{clamp(math.Min(float64(r), af)), clamp(math.Min(float64(g), af)), clamp(math.Min(float64(b), af))}
+	for c := range out {
+		if k.Channels != "" && !strings.ContainsRune(k.Channels, rune("rgb"[c])) {
+			continue
+		}
+		if k.Divisor != 0 {
+			sums[c] /= k.Divisor
+		}
+		// The bias is premultiplied by the alpha of the pixel.
+		out[c] = clamp(math.Min(sums[c]+k.Bias*af, af))
+	}
+	return out[0], out[1], out[2], uint16(a)
+}
+
+// Return the output channels of the pixel at offset i of the input plane of an image in linear light,
+// like finish without rounding.
+func (k *Kernel) finishLinear(inPix []float32, i int, rNew float64, gNew float64, bNew float64, aNew float64, blend bool) (float64, float64, float64, float64) {
+	r, g, b, a := readFloat(inPix, i)
+	if blend {
+		if k.Divisor != 0 {
+			aNew /= k.Divisor
+		}
+		a = clampFloat(aNew)
+	}
+	sums := [3]float64{rNew, gNew, bNew}
+	out := [3]float64{math.Min(r, a), math.Min(g, a), math.Min(b, a)}
+	for c := range out {
+		if k.Channels != "" && !strings.ContainsRune(k.Channels, rune("rgb"[c])) {
+			continue
+		}
+		if k.Divisor != 0 {
+			sums[c] /= k.Divisor
+		}
+		out[c] = clampFloat(math.Min(sums[c]+k.Bias*a, a))
+	}
+	return out[0], out[1], out[2], a
+}
+
+// Sum returns the sum of all the weights of the kernel.
+func (k *Kernel) Sum() float64 {
+	if k.Separable() {
+		return sum(k.Row) * sum(k.Col)
+	}
+	return sum(k.Weights)
+}
+
+// Perform the designated kernel to the image slice from start to end position, concatenating row-wise.
+// Neighbours outside of the image bounds are read according to the border policy.
+func (img *Image) PerformKernel(kernel *Kernel, border Border, start int, end int) {
+	if kernel.Separable() {
+		img.performSeparable(kernel, border, start, end)
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := kernel.Radius()
+	kSum := kernel.Sum()
+	blend := kernel.averages()
+	inPix, inStride := img.in.Pix, img.in.Stride
+	outPix, outStride := img.out.Pix, img.out.Stride
+
+	// Pix offsets of the neighbouring rows and columns of a pixel, -1 if the neighbour is skipped.
+	rowOffs := make([]int, kernel.Size)
+	colOffs := make([]int, kernel.Size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			border.offsets(rowOffs, y-radius, yMin, yMax, inStride)
+		}
+		border.offsets(colOffs, x-radius, xMin, xMax, 8)
+
+		kIndex := 0
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for _, rowOff := range rowOffs {
+			for _, colOff := range colOffs {
+				kMult := kernel.Weights[kIndex]
+				if rowOff >= 0 && colOff >= 0 {
+					r, g, b, a := readPixel(inPix, rowOff+colOff)
+					rNew += float64(r) * kMult
+					gNew += float64(g) * kMult
+					bNew += float64(b) * kMult
+					aNew += float64(a) * kMult
+					wSum += kMult
+				} else {
+					skipped = true
+					aNew += paddingAlpha(border) * kMult
+				}
+				kIndex += 1
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, kSum, wSum), renormalize(gNew, kSum, wSum), renormalize(bNew, kSum, wSum)
+			aNew = renormalize(aNew, kSum, wSum)
+		}
+		rOut, gOut, bOut, a := kernel.finish(inPix, pixOffset(k, n, inStride), rNew, gNew, bNew, aNew, blend)
+		writePixel(outPix, pixOffset(k, n, outStride), rOut, gOut, bOut, a)
+	}
+}
+
+// Perform a separable kernel to the image slice from start to end position.
+// The horizontal pass covers every row the slice reads from, including the rows of
+// neighbouring slices within the kernel radius, so no synchronization between slices is needed.
+func (img *Image) performSeparable(kernel *Kernel, border Border, start int, end int) {
+	if start >= end {
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := kernel.Radius()
+	rowSum, colSum := sum(kernel.Row), sum(kernel.Col)
+	blend := kernel.averages()
+	inPix, inStride := img.in.Pix, img.in.Stride
+	outPix, outStride := img.out.Pix, img.out.Stride
+
+	// Rows read by the vertical pass, indexed by their position in the temporary buffer.
+	rowFirst, rowLast := start/n+yMin, (end-1)/n+yMin
+	rows := make(map[int]int)
+	for y := rowFirst - radius; y <= rowLast+radius; y++ {
+		if yy, ok := border.index(y, yMin, yMax); ok {
+			if _, seen := rows[yy]; !seen {
+				rows[yy] = len(rows)
+			}
+		}
+	}
+
+	// Horizontal pass, storing the rgba sums of each row in a temporary buffer.
+	tmp := make([]float64, len(rows)*n*4)
+	colOffs := make([]int, kernel.Size)
+	for y, row := range rows {
+		rowOff := (y - yMin) * inStride
+		for x := xMin; x < xMax; x++ {
+			border.offsets(colOffs, x-radius, xMin, xMax, 8)
+			rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+			wSum, skipped := float64(0), false
+			for j, colOff := range colOffs {
+				kMult := kernel.Row[j]
+				if colOff >= 0 {
+					r, g, b, a := readPixel(inPix, rowOff+colOff)
+					rNew += float64(r) * kMult
+					gNew += float64(g) * kMult
+					bNew += float64(b) * kMult
+					aNew += float64(a) * kMult
+					wSum += kMult
+				} else {
+					skipped = true
+					aNew += paddingAlpha(border) * kMult
+				}
+			}
+			if skipped && border == BorderRenormalize {
+				rNew, gNew, bNew = renormalize(rNew, rowSum, wSum), renormalize(gNew, rowSum, wSum), renormalize(bNew, rowSum, wSum)
+				aNew = renormalize(aNew, rowSum, wSum)
+			}
+			t := (row*n + x - xMin) * 4
+			tmp[t], tmp[t+1], tmp[t+2], tmp[t+3] = rNew, gNew, bNew, aNew
+		}
+	}
+
+	// Vertical pass over the slice, where tmpOffs are the temporary buffer offsets of the
+	// neighbouring rows of a pixel, -1 if the neighbour is skipped.
+	tmpOffs := make([]int, kernel.Size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			for i := range tmpOffs {
+				tmpOffs[i] = -1
+				if yy, ok := border.index(y+i-radius, yMin, yMax); ok {
+					tmpOffs[i] = rows[yy] * n * 4
+				}
+			}
+		}
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for i, tmpOff := range tmpOffs {
+			kMult := kernel.Col[i]
+			if tmpOff >= 0 {
+				t := tmpOff + (x-xMin)*4
+				rNew += tmp[t] * kMult
+				gNew += tmp[t+1] * kMult
+				bNew += tmp[t+2] * kMult
+				aNew += tmp[t+3] * kMult
+				wSum += kMult
+			} else {
+				skipped = true
+				// A skipped row is padded as a whole.
+				aNew += paddingAlpha(border) * rowSum * kMult
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, colSum, wSum), renormalize(gNew, colSum, wSum), renormalize(bNew, colSum, wSum)
+			aNew = renormalize(aNew, colSum, wSum)
+		}
+		rOut, gOut, bOut, a := kernel.finish(inPix, pixOffset(k, n, inStride), rNew, gNew, bNew, aNew, blend)
+		writePixel(outPix, pixOffset(k, n, outStride), rOut, gOut, bOut, a)
+	}
+}
+
+// Perform a one-dimensional kernel along the rows, if horizontal, or along the columns of the image
+// slice from start to end position. Two passes perform a separable kernel, where the second pass
+// must start once the first one is complete on the whole image.
+func (img *Image) performPass(weights []float64, horizontal bool, border Border, start int, end int) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := len(weights) / 2
+	total := sum(weights)
+	blend := nonNegative(weights) && math.Abs(total-1) < 1e-9
+	inPix, inStride := img.in.Pix, img.in.Stride
+	outPix, outStride := img.out.Pix, img.out.Stride
+
+	// Pix offsets of the neighbours of a pixel along the pass, -1 if the neighbour is skipped.
+	offs := make([]int, len(weights))
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		// The neighbours are offset from the start of the row, or from the top of the column.
+		base := (y - yMin) * inStride
+		if horizontal {
+			border.offsets(offs, x-radius, xMin, xMax, 8)
+		} else {
+			base = (x - xMin) * 8
+			if k == start || x == xMin {
+				border.offsets(offs, y-radius, yMin, yMax, inStride)
+			}
+		}
+
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for i, off := range offs {
+			kMult := weights[i]
+			if off >= 0 {
+				r, g, b, a := readPixel(inPix, base+off)
+				rNew += float64(r) * kMult
+				gNew += float64(g) * kMult
+				bNew += float64(b) * kMult
+				aNew += float64(a) * kMult
+				wSum += kMult
+			} else {
+				skipped = true
+				aNew += paddingAlpha(border) * kMult
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, total, wSum), renormalize(gNew, total, wSum), renormalize(bNew, total, wSum)
+			aNew = renormalize(aNew, total, wSum)
+		}
+		// The alpha channel of a weighted average is averaged, and copied from the center pixel otherwise.
+		_, _, _, a := readPixel(inPix, pixOffset(k, n, inStride))
+		if blend {
+			a = uint32(clamp(math.Round(aNew)))
+		}
+		writePixel(outPix, pixOffset(k, n, outStride), clamp(rNew), clamp(gNew), clamp(bNew), uint16(a))
+	}
+}
+
+// Return the alpha of the neighbours skipped by the border policy. The zero border pads the image
+// with opaque black, so that the edges of an opaque image stay opaque.
+func paddingAlpha(border Border) float64 {
+	if border == BorderZero {
+		return 0xffff
+	}
+	return 0
+}
+
+// Rescale a partial convolution sum by the total weight over the weight of the neighbours used.
+func renormalize(value float64, total float64, used float64) float64 {
+	if used == 0 {
+		return value
+	}
+	return value * total / used
+}
+
+// Sum of the weights.
+func sum(weights []float64) float64 {
+	total := float64(0)
+	for _, w := range weights {
+		total += w
+	}
+	return total
+}
+
+// Perform the kernel on the float planes of an image in linear light, like PerformKernel.
+func (img *Image) performKernelLinear(kernel *Kernel, border Border, start int, end int) {
+	if kernel.Separable() {
+		img.performSeparableLinear(kernel, border, start, end)
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := kernel.Radius()
+	kSum := kernel.Sum()
+	blend := kernel.averages()
+	inPix, inStride := img.fin.Pix, img.fin.Stride
+	outPix, outStride := img.fout.Pix, img.fout.Stride
+
+	rowOffs := make([]int, kernel.Size)
+	colOffs := make([]int, kernel.Size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			border.offsets(rowOffs, y-radius, yMin, yMax, inStride)
+		}
+		border.offsets(colOffs, x-radius, xMin, xMax, 4)
+
+		kIndex := 0
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for _, rowOff := range rowOffs {
+			for _, colOff := range colOffs {
+				kMult := kernel.Weights[kIndex]
+				if rowOff >= 0 && colOff >= 0 {
+					r, g, b, a := readFloat(inPix, rowOff+colOff)
+					rNew += r * kMult
+					gNew += g * kMult
+					bNew += b * kMult
+					aNew += a * kMult
+					wSum += kMult
+				} else {
+					skipped = true
+					aNew += paddingAlpha(border) * kMult
+				}
+				kIndex += 1
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, kSum, wSum), renormalize(gNew, kSum, wSum), renormalize(bNew, kSum, wSum)
+			aNew = renormalize(aNew, kSum, wSum)
+		}
+		r, g, b, a := kernel.finishLinear(inPix, floatOffset(k, n, inStride), rNew, gNew, bNew, aNew, blend)
+		writeFloat(outPix, floatOffset(k, n, outStride), r, g, b, a)
+	}
+}
+
+// Perform a separable kernel on the float planes of an image in linear light, like performSeparable.
+func (img *Image) performSeparableLinear(kernel *Kernel, border Border, start int, end int) {
+	if start >= end {
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := kernel.Radius()
+	rowSum, colSum := sum(kernel.Row), sum(kernel.Col)
+	blend := kernel.averages()
+	inPix, inStride := img.fin.Pix, img.fin.Stride
+	outPix, outStride := img.fout.Pix, img.fout.Stride
+
+	rowFirst, rowLast := start/n+yMin, (end-1)/n+yMin
+	rows := make(map[int]int)
+	for y := rowFirst - radius; y <= rowLast+radius; y++ {
+		if yy, ok := border.index(y, yMin, yMax); ok {
+			if _, seen := rows[yy]; !seen {
+				rows[yy] = len(rows)
+			}
+		}
+	}
+
+	tmp := make([]float64, len(rows)*n*4)
+	colOffs := make([]int, kernel.Size)
+	for y, row := range rows {
+		rowOff := (y - yMin) * inStride
+		for x := xMin; x < xMax; x++ {
+			border.offsets(colOffs, x-radius, xMin, xMax, 4)
+			rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+			wSum, skipped := float64(0), false
+			for j, colOff := range colOffs {
+				kMult := kernel.Row[j]
+				if colOff >= 0 {
+					r, g, b, a := readFloat(inPix, rowOff+colOff)
+					rNew += r * kMult
+					gNew += g * kMult
+					bNew += b * kMult
+					aNew += a * kMult
+					wSum += kMult
+				} else {
+					skipped = true
+					aNew += paddingAlpha(border) * kMult
+				}
+			}
+			if skipped && border == BorderRenormalize {
+				rNew, gNew, bNew = renormalize(rNew, rowSum, wSum), renormalize(gNew, rowSum, wSum), renormalize(bNew, rowSum, wSum)
+				aNew = renormalize(aNew, rowSum, wSum)
+			}
+			t := (row*n + x - xMin) * 4
+			tmp[t], tmp[t+1], tmp[t+2], tmp[t+3] = rNew, gNew, bNew, aNew
+		}
+	}
+
+	tmpOffs := make([]int, kernel.Size)
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		if k == start || x == xMin {
+			for i := range tmpOffs {
+				tmpOffs[i] = -1
+				if yy, ok := border.index(y+i-radius, yMin, yMax); ok {
+					tmpOffs[i] = rows[yy] * n * 4
+				}
+			}
+		}
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for i, tmpOff := range tmpOffs {
+			kMult := kernel.Col[i]
+			if tmpOff >= 0 {
+				t := tmpOff + (x-xMin)*4
+				rNew += tmp[t] * kMult
+				gNew += tmp[t+1] * kMult
+				bNew += tmp[t+2] * kMult
+				aNew += tmp[t+3] * kMult
+				wSum += kMult
+			} else {
+				skipped = true
+				aNew += paddingAlpha(border) * rowSum * kMult
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, colSum, wSum), renormalize(gNew, colSum, wSum), renormalize(bNew, colSum, wSum)
+			aNew = renormalize(aNew, colSum, wSum)
+		}
+		r, g, b, a := kernel.finishLinear(inPix, floatOffset(k, n, inStride), rNew, gNew, bNew, aNew, blend)
+		writeFloat(outPix, floatOffset(k, n, outStride), r, g, b, a)
+	}
+}
+
+// Perform a one-dimensional kernel on the float planes of an image in linear light, like performPass.
+func (img *Image) performPassLinear(weights []float64, horizontal bool, border Border, start int, end int) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	radius := len(weights) / 2
+	total := sum(weights)
+	blend := nonNegative(weights) && math.Abs(total-1) < 1e-9
+	inPix, inStride := img.fin.Pix, img.fin.Stride
+	outPix, outStride := img.fout.Pix, img.fout.Stride
+
+	offs := make([]int, len(weights))
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		base := (y - yMin) * inStride
+		if horizontal {
+			border.offsets(offs, x-radius, xMin, xMax, 4)
+		} else {
+			base = (x - xMin) * 4
+			if k == start || x == xMin {
+				border.offsets(offs, y-radius, yMin, yMax, inStride)
+			}
+		}
+
+		rNew, gNew, bNew, aNew := float64(0), float64(0), float64(0), float64(0)
+		wSum, skipped := float64(0), false
+		for i, off := range offs {
+			kMult := weights[i]
+			if off >= 0 {
+				r, g, b, a := readFloat(inPix, base+off)
+				rNew += r * kMult
+				gNew += g * kMult
+				bNew += b * kMult
+				aNew += a * kMult
+				wSum += kMult
+			} else {
+				skipped = true
+				aNew += paddingAlpha(border) * kMult
+			}
+		}
+		if skipped && border == BorderRenormalize {
+			rNew, gNew, bNew = renormalize(rNew, total, wSum), renormalize(gNew, total, wSum), renormalize(bNew, total, wSum)
+			aNew = renormalize(aNew, total, wSum)
+		}
+		_, _, _, a := readFloat(inPix, floatOffset(k, n, inStride))
+		if blend {
+			a = clampFloat(aNew)
+		}
+		writeFloat(outPix, floatOffset(k, n, outStride), clampFloat(rNew), clampFloat(gNew), clampFloat(bNew), a)
+	}
+}
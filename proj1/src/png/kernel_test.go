@@ -0,0 +1,236 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// newTestImage returns a w x h image filled with a deterministic pattern.
+func newTestImage(w int, h int) *Image {
+	bounds := image.Rect(0, 0, w, h)
+	in := image.NewRGBA64(bounds)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			in.Set(x, y, color.RGBA64{uint16(x * 997 % 65536), uint16(y * 1543 % 65536), uint16((x + y) * 3001 % 65536), 65535})
+		}
+	}
+	return &Image{in: in, out: image.NewRGBA64(bounds), Bounds: bounds}
+}
+
+func TestNewKernel(t *testing.T) {
+	if _, err := NewKernel(4, make([]float64, 16)); err == nil {
+		t.Errorf("FAILED: even kernel size should be rejected")
+	}
+	if _, err := NewKernel(5, make([]float64, 9)); err == nil {
+		t.Errorf("FAILED: mismatched kernel weights should be rejected")
+	}
+	if _, err := NewSeparableKernel([]float64{1, 2, 1}, []float64{1, 1}); err == nil {
+		t.Errorf("FAILED: mismatched separable factors should be rejected")
+	}
+	kernel, err := NewKernel(7, make([]float64, 49))
+	if err != nil || kernel.Radius() != 3 {
+		t.Errorf("FAILED: 7x7 kernel should have radius 3, got %v (%v)", kernel, err)
+	}
+}
+
+func TestSeparableMatchesFullKernel(t *testing.T) {
+	factor := []float64{1 / 16.0, 4 / 16.0, 6 / 16.0, 4 / 16.0, 1 / 16.0}
+	weights := make([]float64, 25)
+	for i := range factor {
+		for j := range factor {
+			weights[i*5+j] = factor[i] * factor[j]
+		}
+	}
+	full, _ := NewKernel(5, weights)
+	separable, _ := NewSeparableKernel(factor, factor)
+
+	img := newTestImage(23, 17)
+	bd := 23 * 17
+	img.PerformKernel(full, BorderZero, 0, bd)
+	expected := image.NewRGBA64(img.Bounds)
+	copy(expected.Pix, img.out.Pix)
+
+	// Perform the separable kernel in uneven slices as parslices would.
+	for _, chunk := range [][2]int{{0, 50}, {50, 51}, {51, 200}, {200, bd}} {
+		img.PerformKernel(separable, BorderZero, chunk[0], chunk[1])
+	}
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 23; x++ {
+			r1, g1, b1, a1 := expected.At(x, y).RGBA()
+			r2, g2, b2, a2 := img.out.At(x, y).RGBA()
+			if absDiff(r1, r2) > 1 || absDiff(g1, g2) > 1 || absDiff(b1, b2) > 1 || a1 != a2 {
+				t.Fatalf("FAILED: pixel (%v,%v) differs: %v,%v,%v,%v vs %v,%v,%v,%v", x, y, r1, g1, b1, a1, r2, g2, b2, a2)
+			}
+		}
+	}
+}
+
+func absDiff(a uint32, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestBorderIndex(t *testing.T) {
+	cases := []struct {
+		border   Border
+		i        int
+		expected int
+		ok       bool
+	}{
+		{BorderZero, -1, -1, false},
+		{BorderClamp, -2, 0, true},
+		{BorderClamp, 7, 4, true},
+		{BorderMirror, -1, 1, true},
+		{BorderMirror, -2, 2, true},
+		{BorderMirror, 5, 3, true},
+		{BorderMirror, 9, 1, true},
+		{BorderWrap, -1, 4, true},
+		{BorderWrap, 6, 1, true},
+		{BorderRenormalize, 5, 5, false},
+	}
+	for _, c := range cases {
+		i, ok := c.border.index(c.i, 0, 5)
+		if ok != c.ok || (ok && i != c.expected) {
+			t.Errorf("FAILED: %v.index(%v) = %v,%v, expected %v,%v", c.border, c.i, i, ok, c.expected, c.ok)
+		}
+	}
+	if _, err := ParseBorder("reflect"); err == nil {
+		t.Errorf("FAILED: unknown border mode should be rejected")
+	}
+}
+
+func TestBorderPreservesFlatImage(t *testing.T) {
+	bounds := image.Rect(0, 0, 9, 6)
+	in := image.NewRGBA64(bounds)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 9; x++ {
+			in.Set(x, y, color.RGBA64{30000, 30000, 30000, 65535})
+		}
+	}
+	img := &Image{in: in, out: image.NewRGBA64(bounds), Bounds: bounds}
+	for _, border := range []Border{BorderClamp, BorderMirror, BorderWrap, BorderRenormalize} {
+		img.Blur(border, 0, 54)
+		for _, p := range []image.Point{{0, 0}, {8, 5}, {4, 0}, {0, 3}} {
+			if r, _, _, _ := img.out.At(p.X, p.Y).RGBA(); absDiff(r, 30000) > 1 {
+				t.Errorf("FAILED: %v blur changed flat pixel %v to %v", border, p, r)
+			}
+		}
+	}
+	img.Blur(BorderZero, 0, 54)
+	if r, _, _, _ := img.out.At(0, 0).RGBA(); r != 30000*4/9 {
+		t.Errorf("FAILED: zero border corner should be darkened to %v, got %v", 30000*4/9, r)
+	}
+}
+
+func TestKernelAlpha(t *testing.T) {
+	// Opaque red on the left, transparent on the right.
+	newHalfImage := func() *Image {
+		bounds := image.Rect(0, 0, 12, 6)
+		img := &Image{in: image.NewRGBA64(bounds), out: image.NewRGBA64(bounds), Bounds: bounds}
+		for y := 0; y < 6; y++ {
+			for x := 0; x < 6; x++ {
+				writePixel(img.in.Pix, img.in.PixOffset(x, y), 0xffff, 0, 0, 0xffff)
+			}
+		}
+		return img
+	}
+
+	// Averaging kernels fade the alpha at the edge without darkening the color.
+	blurs := []struct {
+		name   string
+		params map[string]any
+	}{
+		{"B", map[string]any{"border": "clamp"}},
+		{"gaussian", map[string]any{"border": "clamp", "sigma": 1.5}},
+		{"boxblur", map[string]any{"border": "renormalize", "radius": 2}},
+		{"kernel", map[string]any{"border": "mirror", "matrix": []any{1.0, 2.0, 1.0, 2.0, 4.0, 2.0, 1.0, 2.0, 1.0}, "divisor": 16}},
+	}
+	for _, blur := range blurs {
+		effect, err := NewEffect(blur.name, blur.params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		staged, unstaged := newHalfImage(), newHalfImage()
+		applyStages(staged, effect, 7)
+		effect.Apply(unstaged, 0, 12*6)
+		for _, img := range []*Image{staged, unstaged} {
+			for x := 5; x < 7; x++ {
+				p := outPixel(img, x, 3)
+				if p[3] == 0 || p[3] == 0xffff || p[1] != 0 || absDiff(p[0], p[3]) > 1 {
+					t.Errorf("FAILED: %v pixel %v at the edge is %v", blur.name, x, p)
+				}
+			}
+			if p := outPixel(img, 0, 0); absDiff(p[0], 0xffff) > 1 || p[3] != 0xffff {
+				t.Errorf("FAILED: %v pixel away from the edge is %v", blur.name, p)
+			}
+		}
+	}
+
+	// The edge detector keeps the alpha channel of each pixel.
+	img := newHalfImage()
+	edge, err := NewEffect("E", map[string]any{"border": "clamp"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	applyStages(img, edge, 12*6)
+	for x := 0; x < 12; x++ {
+		if p, q := outPixel(img, x, 3), inPixel(img, x, 3); p[3] != q[3] {
+			t.Errorf("FAILED: edge detection changes the alpha of pixel %v to %v", x, p)
+		}
+	}
+
+	// Sharpening a translucent pixel lighter than its neighbours keeps its colors within its alpha,
+	// so that it is saved white rather than wrapped around.
+	img = newStepImage(5, 5, func(x int, y int) uint16 { return 0x4000 })
+	for k := 0; k < 25; k++ {
+		v := uint16(0x2000)
+		if k == 12 {
+			v = 0x7000
+		}
+		writePixel(img.in.Pix, k*8, v, v, v, 0x8000)
+	}
+	sharpen, err := NewEffect("S", map[string]any{"border": "clamp"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	applyStages(img, sharpen, 25)
+	if p := outPixel(img, 2, 2); p[0] != p[3] {
+		t.Errorf("FAILED: sharpened translucent pixel is %v", p)
+	}
+	for _, depth := range []int{8, 16} {
+		saved := roundTrip(t, img, SaveOptions{BitDepth: depth}).At(2, 2)
+		if c := color.NRGBA64Model.Convert(saved).(color.NRGBA64); c.R != 0xffff {
+			t.Errorf("FAILED: sharpened translucent pixel is saved as %v with bit depth %v", c, depth)
+		}
+	}
+
+	// The zero border pads with opaque black, so an opaque image stays opaque.
+	for _, name := range []string{"gaussian", "blur", "boxblur"} {
+		params := map[string]any{"radius": 3}
+		if name == "gaussian" {
+			params = map[string]any{"sigma": 2}
+		}
+		effect, err := NewEffect(name, params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newTestImage(9, 7)
+		applyStages(img, effect, 9*7)
+		if !img.out.Opaque() {
+			t.Errorf("FAILED: %v makes an opaque image translucent", name)
+		}
+	}
+}
+
+func TestKernelAverages(t *testing.T) {
+	// A box kernel averages the alpha channel only when it applies to all of r, g and b, in any order.
+	for channels, expected := range map[string]bool{"": true, "rgb": true, "bgr": true, "gbrg": true, "rg": false, "b": false} {
+		k := &Kernel{Size: 3, Weights: []float64{1, 1, 1, 1, 1, 1, 1, 1, 1}, Divisor: 9, Channels: channels}
+		if k.averages() != expected {
+			t.Errorf("FAILED: kernel on channels %q averages is %v, expected %v", channels, !expected, expected)
+		}
+	}
+}
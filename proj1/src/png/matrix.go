@@ -0,0 +1,170 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"math"
+)
+
+// The largest number of posterize levels and the largest magnitude of a matrix divisor.
+const (
+	maxPosterizeLevels = 256
+	maxMatrixDivisor   = 1e6
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "matrix", Params: []string{"matrix", "divisor"}, New: newMatrixEffect})
+	RegisterEffect(EffectSpec{Name: "sepia", Params: []string{"amount"}, New: newSepiaEffect})
+	RegisterEffect(EffectSpec{Name: "invert", New: newInvertEffect})
+	RegisterEffect(EffectSpec{Name: "posterize", Params: []string{"levels"}, New: newPosterizeEffect})
+}
+
+// The matrices of the presets.
+var (
+	grayscaleMatrix = []float64{1, 1, 1, 0, 1, 1, 1, 0, 1, 1, 1, 0}
+	sepiaMatrix     = []float64{0.393, 0.769, 0.189, 0, 0.349, 0.686, 0.168, 0, 0.272, 0.534, 0.131, 0}
+	identityMatrix  = []float64{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0}
+	invertMatrix    = []float64{-1, 0, 0, 1, 0, -1, 0, 1, 0, 0, -1, 1}
+)
+
+// A matrixEffect mixes the channels of each pixel with a color matrix, whose rows give
+// the output channels and whose columns weight the input channels, followed by a constant
+// offset as a fraction of the largest value. A 3x4 matrix mixes the rgb channels and keeps alpha,
+// a 4x5 matrix mixes all four channels. Every output channel is divided by the divisor.
+type matrixEffect struct {
+	name    string         // "matrix", or the name of the preset
+	params  map[string]any // The parameters of a preset
+	matrix  []float64      // The row-major coefficients
+	divisor float64
+}
+
+// Create a color matrix effect from the 12 or 20 coefficients of the "matrix"
+// and the "divisor" of every output channel, 1 by default.
+func newMatrixEffect(params map[string]any) (Effect, error) {
+	matrix, err := paramFloats(params, "matrix", 12, 20)
+	if err != nil {
+		return nil, err
+	}
+	if matrix == nil {
+		return nil, errors.New("png: matrix effect needs a matrix")
+	}
+	divisor, err := paramFloat(params, "divisor", 1, -maxMatrixDivisor, maxMatrixDivisor)
+	if err != nil {
+		return nil, err
+	}
+	if divisor == 0 {
+		return nil, errors.New("png: matrix divisor must not be zero")
+	}
+	return &matrixEffect{name: "matrix", matrix: matrix, divisor: divisor}, nil
+}
+
+// Create the grayscale preset, the mean of the rgb channels.
+func newGrayscaleEffect(params map[string]any) (Effect, error) {
+	return &matrixEffect{name: "grayscale", params: map[string]any{}, matrix: grayscaleMatrix, divisor: 3}, nil
+}
+
+// Create the sepia preset, blended with the original colors by "amount" within [0, 1], 1 by default.
+func newSepiaEffect(params map[string]any) (Effect, error) {
+	amount, err := paramFloat(params, "amount", 1, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	matrix := make([]float64, len(sepiaMatrix))
+	for i := range matrix {
+		matrix[i] = amount*sepiaMatrix[i] + (1-amount)*identityMatrix[i]
+	}
+	return &matrixEffect{name: "sepia", params: map[string]any{"amount": amount}, matrix: matrix, divisor: 1}, nil
+}
+
+// Create the invert preset, which takes no parameters.
+func newInvertEffect(params map[string]any) (Effect, error) {
+	return &matrixEffect{name: "invert", params: map[string]any{}, matrix: invertMatrix, divisor: 1}, nil
+}
+
+func (e *matrixEffect) Name() string { return e.name }
+
+func (e *matrixEffect) Params() map[string]any {
+	if e.name != "matrix" {
+		params := map[string]any{}
+		for k, v := range e.params {
+			params[k] = v
+		}
+		return params
+	}
+	return map[string]any{"matrix": append([]float64(nil), e.matrix...), "divisor": e.divisor}
+}
+
+func (e *matrixEffect) Radius() int { return 0 }
+
+func (e *matrixEffect) Apply(img *Image, start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	m, d := e.matrix, e.divisor
+	for k := start; k < end; k++ {
+		r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+		rf, gf, bf, af := float64(r), float64(g), float64(b), float64(a)
+		if len(m) == 12 {
+			// The rgb mix is linear and the offset is scaled by alpha, so it applies to the
+			// premultiplied channels directly. A channel cannot exceed alpha.
+			rgb := [3]uint16{}
+			for c := range rgb {
+				rgb[c] = clamp(math.Min((m[c*4]*rf+m[c*4+1]*gf+m[c*4+2]*bf+m[c*4+3]*af)/d, af))
+			}
+			writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), rgb[0], rgb[1], rgb[2], uint16(a))
+			continue
+		}
+		// Alpha changes, so the channels are mixed without premultiplication.
+		r, g, b = unpremultiply(r, g, b, a)
+		rf, gf, bf = float64(r), float64(g), float64(b)
+		rgba := [4]uint32{}
+		for c := range rgba {
+			rgba[c] = uint32(clamp((m[c*5]*rf + m[c*5+1]*gf + m[c*5+2]*bf + m[c*5+3]*af + m[c*5+4]*0xffff) / d))
+		}
+		na := rgba[3]
+		// The output is premultiplied by the new alpha.
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride),
+			uint16(rgba[0]*na/0xffff), uint16(rgba[1]*na/0xffff), uint16(rgba[2]*na/0xffff), uint16(na))
+	}
+}
+
+func (e *matrixEffect) ApplyLinear(img *Image, start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	m, d := e.matrix, e.divisor
+	for k := start; k < end; k++ {
+		r, g, b, a := readFloat(img.fin.Pix, floatOffset(k, n, img.fin.Stride))
+		i := floatOffset(k, n, img.fout.Stride)
+		if len(m) == 12 {
+			rgb := [3]float64{}
+			for c := range rgb {
+				rgb[c] = clampFloat(math.Min((m[c*4]*r+m[c*4+1]*g+m[c*4+2]*b+m[c*4+3]*a)/d, a))
+			}
+			writeFloat(img.fout.Pix, i, rgb[0], rgb[1], rgb[2], a)
+			continue
+		}
+		if a > 0 {
+			r, g, b = r/a*0xffff, g/a*0xffff, b/a*0xffff
+		}
+		rgba := [4]float64{}
+		for c := range rgba {
+			rgba[c] = clampFloat((m[c*5]*r + m[c*5+1]*g + m[c*5+2]*b + m[c*5+3]*a + m[c*5+4]*0xffff) / d)
+		}
+		na := rgba[3] / 0xffff
+		writeFloat(img.fout.Pix, i, rgba[0]*na, rgba[1]*na, rgba[2]*na, rgba[3])
+	}
+}
+
+// Create a posterize effect, which rounds each channel to the nearest of "levels" evenly spaced
+// values, 4 by default.
+func newPosterizeEffect(params map[string]any) (Effect, error) {
+	levels, err := paramInt(params, "levels", 4, 2, maxPosterizeLevels)
+	if err != nil {
+		return nil, err
+	}
+	steps := float64(levels - 1)
+	return &colorEffect{name: "posterize", params: map[string]any{"levels": levels},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			return math.Round(r*steps) / steps, math.Round(g*steps) / steps, math.Round(b*steps) / steps
+		}}, nil
+}
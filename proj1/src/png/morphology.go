@@ -0,0 +1,218 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"fmt"
+	"image"
+)
+
+// The largest radius of the structuring elements.
+const maxMorphologyRadius = 50
+
+// The morphological operations.
+const (
+	morphErode = iota
+	morphDilate
+	morphOpen
+	morphClose
+	morphGradient
+)
+
+var morphNames = []string{"erode", "dilate", "open", "close", "gradient"}
+
+func init() {
+	for op, name := range morphNames {
+		RegisterEffect(EffectSpec{Name: name, Params: []string{"border", "shape", "radius", "binary", "threshold"},
+			New: newMorphologyEffect(op)})
+	}
+}
+
+// A morphologyEffect is a morphological operation with a structuring element.
+// Erosion and dilation take the minimum and maximum of each channel over the element,
+// the gradient is their difference, and opening and closing chain them in two stages.
+// A binary operation first thresholds the intensity of the pixels to black or white.
+// The channels are compared without premultiplication, so translucent pixels keep their color.
+// An image in linear light is compared through its sRGB values, where the binary threshold is
+// defined and whose order is the same.
+type morphologyEffect struct {
+	op        int
+	shape     string
+	radius    int
+	border    Border
+	binary    bool
+	threshold float64
+	element   []image.Point // The offsets of the structuring element
+}
+
+// Return the factory of the morphological operation, whose parameters are the "shape" of the
+// structuring element, "square", "cross" or "disk", its "radius", 1 by default, and with
+// "binary" set, the intensity "threshold" of white pixels as a fraction of the largest intensity, 0.5 by default.
+func newMorphologyEffect(op int) func(params map[string]any) (Effect, error) {
+	return func(params map[string]any) (Effect, error) {
+		e := &morphologyEffect{op: op, shape: "square"}
+		var err error
+		if e.border, err = paramBorder(params, "border"); err != nil {
+			return nil, err
+		}
+		if v, ok := params["shape"]; ok {
+			if e.shape, ok = v.(string); !ok {
+				return nil, fmt.Errorf("png: parameter %q must be a string, got %v", "shape", v)
+			}
+		}
+		if e.radius, err = paramInt(params, "radius", 1, 1, maxMorphologyRadius); err != nil {
+			return nil, err
+		}
+		if v, ok := params["binary"]; ok {
+			if e.binary, ok = v.(bool); !ok {
+				return nil, fmt.Errorf("png: parameter %q must be a boolean, got %v", "binary", v)
+			}
+		}
+		if e.threshold, err = paramFloat(params, "threshold", 0.5, 0, 1); err != nil {
+			return nil, err
+		}
+		if e.element, err = structuringElement(e.shape, e.radius); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+}
+
+// Return the offsets of the structuring element of the given shape and radius.
+func structuringElement(shape string, radius int) ([]image.Point, error) {
+	var element []image.Point
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			switch shape {
+			case "square":
+			case "cross":
+				if dx != 0 && dy != 0 {
+					continue
+				}
+			case "disk":
+				if dx*dx+dy*dy > radius*radius {
+					continue
+				}
+			default:
+				return nil, fmt.Errorf("png: unknown structuring element %q", shape)
+			}
+			element = append(element, image.Point{dx, dy})
+		}
+	}
+	return element, nil
+}
+
+func (e *morphologyEffect) Name() string { return morphNames[e.op] }
+
+func (e *morphologyEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "shape": e.shape, "radius": e.radius, "binary": e.binary, "threshold": e.threshold}
+}
+
+func (e *morphologyEffect) Radius() int {
+	if e.op == morphOpen || e.op == morphClose {
+		return 2 * e.radius
+	}
+	return e.radius
+}
+
+// Return the erosion and dilation of an opening or a closing, in the order they are applied.
+func (e *morphologyEffect) steps() (*morphologyEffect, *morphologyEffect) {
+	erode, dilate := *e, *e
+	erode.op, dilate.op = morphErode, morphDilate
+	if e.op == morphClose {
+		return &dilate, &erode
+	}
+	return &erode, &dilate
+}
+
+// Apply the operation to the image slice. The first step of an opening or a closing is computed
+// first on the rows the second step reads, in a buffer taken from the pool of the image.
+func (e *morphologyEffect) Apply(img *Image, start int, end int) {
+	if start >= end {
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	if e.op == morphOpen || e.op == morphClose {
+		first, second := e.steps()
+		n := xMax - xMin
+		// The rows within the radius of the slice, through the border.
+		read := make([]bool, yMax-yMin)
+		for y := start/n + yMin; y <= (end-1)/n+yMin; y++ {
+			for dy := -e.radius; dy <= e.radius; dy++ {
+				if yy, ok := e.border.index(y+dy, yMin, yMax); ok {
+					read[yy-yMin] = true
+				}
+			}
+		}
+		buf := img.pool.get(img.in.Bounds())
+		defer img.pool.put(buf)
+		tmp := &Image{in: img.in, out: buf, Bounds: img.Bounds}
+		for y, ok := range read {
+			if ok {
+				first.Apply(tmp, y*n, (y+1)*n)
+			}
+		}
+		second.Apply(&Image{in: buf, out: img.out, Bounds: img.Bounds}, start, end)
+		return
+	}
+	n := xMax - xMin
+	inPix, inStride := img.in.Pix, img.in.Stride
+	outPix, outStride := img.out.Pix, img.out.Stride
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		lo := [3]uint32{0xffff, 0xffff, 0xffff}
+		hi := [3]uint32{0, 0, 0}
+		for _, d := range e.element {
+			var v [3]uint32
+			xx, xOk := e.border.index(x+d.X, xMin, xMax)
+			yy, yOk := e.border.index(y+d.Y, yMin, yMax)
+			if xOk && yOk {
+				v = e.read(inPix, (yy-yMin)*inStride+(xx-xMin)*8)
+			} else if e.border != BorderZero {
+				continue
+			}
+			for c := range v {
+				if v[c] < lo[c] {
+					lo[c] = v[c]
+				}
+				if v[c] > hi[c] {
+					hi[c] = v[c]
+				}
+			}
+		}
+		out := lo
+		switch e.op {
+		case morphDilate:
+			out = hi
+		case morphGradient:
+			out = [3]uint32{hi[0] - lo[0], hi[1] - lo[1], hi[2] - lo[2]}
+		}
+		// The output is premultiplied by the alpha of the input.
+		_, _, _, a := readPixel(inPix, pixOffset(k, n, inStride))
+		writePixel(outPix, pixOffset(k, n, outStride), uint16(out[0]*a/0xffff), uint16(out[1]*a/0xffff), uint16(out[2]*a/0xffff), uint16(a))
+	}
+}
+
+// Return the non-premultiplied rgb channels of the pixel at offset i, thresholded to black or white
+// for a binary operation.
+func (e *morphologyEffect) read(pix []uint8, i int) [3]uint32 {
+	r, g, b, a := readPixel(pix, i)
+	r, g, b = unpremultiply(r, g, b, a)
+	if !e.binary {
+		return [3]uint32{r, g, b}
+	}
+	if float64(r+g+b)/3 >= e.threshold*0xffff {
+		return [3]uint32{0xffff, 0xffff, 0xffff}
+	}
+	return [3]uint32{0, 0, 0}
+}
+
+// An opening or a closing is applied as its erosion and dilation stages, through the in/out double buffer.
+func (e *morphologyEffect) Stages(img *Image) []Effect {
+	if e.op != morphOpen && e.op != morphClose {
+		return []Effect{e}
+	}
+	first, second := e.steps()
+	return []Effect{first, second}
+}
@@ -0,0 +1,147 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStructuringElements(t *testing.T) {
+	for shape, size := range map[string]int{"square": 25, "cross": 9, "disk": 13} {
+		element, err := structuringElement(shape, 2)
+		if err != nil || len(element) != size {
+			t.Errorf("FAILED: %v of radius 2 has %v offsets, expected %v (%v)", shape, len(element), size, err)
+		}
+	}
+	if _, err := NewEffect("erode", map[string]any{"shape": "star"}); err == nil {
+		t.Errorf("FAILED: unknown structuring element should be rejected")
+	}
+}
+
+func TestMorphologyChains(t *testing.T) {
+	for _, op := range []string{"open", "close"} {
+		for _, border := range []string{"clamp", "wrap", "zero"} {
+			params := map[string]any{"shape": "disk", "radius": 2, "border": border}
+			effect, err := NewEffect(op, params)
+			if err != nil {
+				t.Fatalf("FAILED: %v", err)
+			}
+			// The chain of separate effects, as written in effects.txt.
+			names := []string{"erode", "dilate"}
+			if op == "close" {
+				names[0], names[1] = names[1], names[0]
+			}
+			expected := newTestImage(17, 13)
+			for _, name := range names {
+				step, _ := NewEffect(name, params)
+				applyStages(expected, step, 17*13)
+				expected.Swap()
+			}
+			expected.Swap()
+
+			img := newTestImage(17, 13)
+			applyStages(img, effect, 20)
+			if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+				t.Errorf("FAILED: %v stages with the %v border differ from the chain of effects", op, border)
+			}
+			// Each slice computes the first step on the rows it reads, in a buffer of the pool.
+			img = newTestImage(17, 13)
+			img.pool = NewPool()
+			for start := 0; start < 17*13; start += 40 {
+				end := start + 40
+				if end > 17*13 {
+					end = 17 * 13
+				}
+				effect.Apply(img, start, end)
+			}
+			if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+				t.Errorf("FAILED: %v with the %v border differs from the chain of effects", op, border)
+			}
+			if stats := img.pool.Stats(); stats.Allocated != 1 || stats.Reused != 5 {
+				t.Errorf("FAILED: %v allocated %v buffers and reused %v, expected 1 and 5", op, stats.Allocated, stats.Reused)
+			}
+		}
+	}
+}
+
+// Return the binary erosion or dilation of the white pixels of a 9x9 grid by the radius 1 cross,
+// where the pixels outside of the grid are black.
+func crossMorphology(white func(x int, y int) bool, dilate bool) func(x int, y int) bool {
+	return func(x int, y int) bool {
+		for _, d := range [][2]int{{0, 0}, {-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			xx, yy := x+d[0], y+d[1]
+			w := xx >= 0 && xx < 9 && yy >= 0 && yy < 9 && white(xx, yy)
+			if w == dilate {
+				return dilate
+			}
+		}
+		return !dilate
+	}
+}
+
+func TestBinaryMorphology(t *testing.T) {
+	// A light 5x5 square with a single pixel hole on a dark background.
+	square := func(x int, y int) uint16 {
+		if x >= 2 && x < 7 && y >= 2 && y < 7 && !(x == 4 && y == 4) {
+			return 0xc000
+		}
+		return 0x2000
+	}
+	inside := func(x int, y int) bool { return square(x, y) == 0xc000 }
+	eroded, dilated := crossMorphology(inside, false), crossMorphology(inside, true)
+	cases := map[string]func(x int, y int) bool{
+		"erode":    eroded,
+		"dilate":   dilated,
+		"open":     crossMorphology(eroded, true),
+		"close":    crossMorphology(dilated, false),
+		"gradient": func(x int, y int) bool { return dilated(x, y) && !eroded(x, y) },
+	}
+	for op, expected := range cases {
+		effect, err := NewEffect(op, map[string]any{"binary": true, "shape": "cross"})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newStepImage(9, 9, square)
+		applyStages(img, effect, 9)
+		for y := 0; y < 9; y++ {
+			for x := 0; x < 9; x++ {
+				r, _, _, _ := img.out.At(x, y).RGBA()
+				if (r == 0xffff) != expected(x, y) || (r != 0xffff && r != 0) {
+					t.Errorf("FAILED: binary %v pixel (%v,%v) is %x", op, x, y, r)
+				}
+			}
+		}
+	}
+	// The hole is filled by the closing.
+	if !cases["close"](4, 4) {
+		t.Errorf("FAILED: closing should fill the hole")
+	}
+}
+
+func TestTranslucentMorphology(t *testing.T) {
+	// A translucent gray square on an opaque white background, whose colors must stay within its alpha.
+	for _, op := range morphNames {
+		for _, binary := range []bool{false, true} {
+			effect, err := NewEffect(op, map[string]any{"binary": binary})
+			if err != nil {
+				t.Fatalf("FAILED: %v", err)
+			}
+			img := newStepImage(9, 9, func(x int, y int) uint16 { return 0xffff })
+			for y := 3; y < 6; y++ {
+				for x := 3; x < 6; x++ {
+					writePixel(img.in.Pix, img.in.PixOffset(x, y), 0x2400, 0x2400, 0x2400, 0x4000)
+				}
+			}
+			applyStages(img, effect, 20)
+			for k := 0; k < 81; k++ {
+				r, g, b, a := readPixel(img.out.Pix, k*8)
+				if r > a || g > a || b > a {
+					t.Fatalf("FAILED: %v pixel %v is %x,%x,%x,%x with binary %v", op, k, r, g, b, a, binary)
+				}
+			}
+			// The translucent center is white, as its color without alpha is above the threshold.
+			if r, _, _, a := readPixel(img.out.Pix, img.out.PixOffset(4, 4)); binary && op == "erode" && r != a {
+				t.Errorf("FAILED: binary erosion of the translucent center is %x with alpha %x", r, a)
+			}
+		}
+	}
+}
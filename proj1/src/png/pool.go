@@ -0,0 +1,154 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"image"
+	"sync"
+)
+
+// A Pool recycles the pixel buffers of released images, so that the images
+// loaded afterwards reuse them instead of allocating new ones.
+// A Pool is safe for use by multiple goroutines.
+type Pool struct {
+	lock      sync.Mutex
+	free      [][]uint8   // The pixel buffers of released images
+	floats    [][]float32 // The float planes of released images in linear light
+	allocated int         // The number of buffers allocated
+	reused    int         // The number of buffers taken from free
+	inUse     int         // The bytes of the buffers handed out and not released yet
+	peak      int         // The maximum of inUse
+	held      int         // The bytes of all the buffers allocated
+}
+
+// PoolStats describes the buffers handed out by a Pool.
+type PoolStats struct {
+	Allocated int // The number of buffers allocated
+	Reused    int // The number of buffers reused from released images
+	PeakBytes int // The maximum size of the buffers in use at the same time
+	HeldBytes int // The size of all the buffers allocated
+}
+
+// NewPool returns an empty buffer pool.
+func NewPool() *Pool {
+	return &Pool{}
+}
+
+// Stats returns the allocation statistics of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return PoolStats{Allocated: p.allocated, Reused: p.reused, PeakBytes: p.peak, HeldBytes: p.held}
+}
+
+// Return an image with the given bounds, whose pixels are undefined.
+// The smallest free buffer large enough is reused, a new one is allocated otherwise.
+// A nil pool always allocates a new image.
+func (p *Pool) get(bounds image.Rectangle) *image.RGBA64 {
+	if p == nil {
+		return image.NewRGBA64(bounds)
+	}
+	n := 8 * bounds.Dx() * bounds.Dy()
+	p.lock.Lock()
+	best := -1
+	for i, pix := range p.free {
+		if cap(pix) >= n && (best < 0 || cap(pix) < cap(p.free[best])) {
+			best = i
+		}
+	}
+	var pix []uint8
+	size := n
+	if best >= 0 {
+		pix = p.free[best][:n]
+		size = cap(pix)
+		p.free[best] = p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		p.reused++
+	} else {
+		p.allocated++
+		p.held += n
+	}
+	p.inUse += size
+	if p.inUse > p.peak {
+		p.peak = p.inUse
+	}
+	p.lock.Unlock()
+
+	// Allocate outside of the lock, the other goroutines need not wait for the zeroing.
+	if pix == nil {
+		pix = make([]uint8, n)
+	}
+	return &image.RGBA64{Pix: pix, Stride: 8 * bounds.Dx(), Rect: bounds}
+}
+
+// Return a float plane with the given bounds, whose values are undefined,
+// reused or allocated like the buffers of get.
+func (p *Pool) getFloat(bounds image.Rectangle) *floatImage {
+	if p == nil {
+		return newFloatImage(bounds)
+	}
+	n := 4 * bounds.Dx() * bounds.Dy()
+	p.lock.Lock()
+	best := -1
+	for i, pix := range p.floats {
+		if cap(pix) >= n && (best < 0 || cap(pix) < cap(p.floats[best])) {
+			best = i
+		}
+	}
+	var pix []float32
+	size := 4 * n
+	if best >= 0 {
+		pix = p.floats[best][:n]
+		size = 4 * cap(pix)
+		p.floats[best] = p.floats[len(p.floats)-1]
+		p.floats = p.floats[:len(p.floats)-1]
+		p.reused++
+	} else {
+		p.allocated++
+		p.held += size
+	}
+	p.inUse += size
+	if p.inUse > p.peak {
+		p.peak = p.inUse
+	}
+	p.lock.Unlock()
+
+	if pix == nil {
+		pix = make([]float32, n)
+	}
+	return &floatImage{Pix: pix, Stride: 4 * bounds.Dx(), Rect: bounds}
+}
+
+// Return the float plane m to the pool.
+func (p *Pool) putFloat(m *floatImage) {
+	if p == nil || m == nil {
+		return
+	}
+	p.lock.Lock()
+	p.floats = append(p.floats, m.Pix)
+	p.inUse -= 4 * cap(m.Pix)
+	p.lock.Unlock()
+}
+
+// Return the pixel buffer of m to the pool.
+func (p *Pool) put(m *image.RGBA64) {
+	if p == nil || m == nil {
+		return
+	}
+	p.lock.Lock()
+	p.free = append(p.free, m.Pix)
+	p.inUse -= cap(m.Pix)
+	p.lock.Unlock()
+}
+
+// Release returns the buffers of the image, and its scratch planes, to the pool it was loaded with.
+// The image must not be used afterwards.
+func (img *Image) Release() {
+	img.ReleasePlanes()
+	img.pool.put(img.in)
+	img.pool.put(img.out)
+	img.pool.putFloat(img.fin)
+	img.pool.putFloat(img.fout)
+	img.in, img.out = nil, nil
+	img.fin, img.fout = nil, nil
+}
@@ -0,0 +1,61 @@
+package png
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransparentRegression(t *testing.T) {
+	// The transparent images of the small data set, with the effects of data/effects.txt,
+	// give the outputs of data/expected. Those were generated by the editor itself, so this
+	// only catches changes of the outputs: the alpha handling is checked by TestKernelAlpha.
+	cases := []struct {
+		in, expected string
+		effects      []Effect
+	}{
+		{"alpha_disk.png", "alpha_disk_Out.png", []Effect{newTestEffect(t, "B", nil), newTestEffect(t, "B", nil), newTestEffect(t, "S", nil)}},
+		{"alpha_fade.png", "alpha_fade_Out.png", []Effect{newTestEffect(t, "blur", map[string]any{"radius": 3}), newTestEffect(t, "G", nil), newTestEffect(t, "E", nil)}},
+	}
+	for _, c := range cases {
+		img, err := Load(filepath.Join("..", "data", "in", "small", c.in))
+		if os.IsNotExist(err) {
+			t.Skipf("regression image %v not found", c.in)
+		}
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		for _, effect := range c.effects {
+			for _, stage := range Stages(effect, img) {
+				stage.Apply(img, 0, img.Prepare(stage))
+				img.Swap()
+			}
+		}
+		img.Swap()
+		out := filepath.Join(t.TempDir(), c.expected)
+		if err := img.Save(out); err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		expected, err := os.ReadFile(filepath.Join("..", "data", "expected", c.expected))
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("FAILED: %v differs from the expected output %v", c.in, c.expected)
+		}
+	}
+}
+
+// Return the registered effect with the given parameters.
+func newTestEffect(t *testing.T, name string, params map[string]any) Effect {
+	effect, err := NewEffect(name, params)
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	return effect
+}
@@ -0,0 +1,229 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// The largest window radius of the adaptive threshold.
+const maxAdaptiveRadius = 100
+
+// The number of intensity levels of the histograms, those of the thresholds and the equalizations.
+const histLevels = 256
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "otsu", New: newOtsuEffect})
+	RegisterEffect(EffectSpec{Name: "adaptive", Params: []string{"border", "method", "radius", "offset"}, New: newAdaptiveEffect})
+}
+
+// The stages of the Otsu threshold.
+const (
+	otsuHistogram = iota // Reduction of the intensity histograms of the slices
+	otsuMap              // Threshold of every pixel
+	otsuStages
+)
+
+// An otsuEffect binarizes the image with the global threshold that maximizes the
+// variance between the intensities of the black and the white pixels.
+// The output is white above the threshold and black elsewhere, with the alpha channel of the input.
+// The intensities are taken without premultiplication, so translucent pixels keep their level,
+// and from the sRGB values of an image in linear light, like the levels of the 1-bit output.
+type otsuEffect struct{}
+
+// The intensity histogram of an image, shared by the stages of the Otsu threshold.
+type otsuState struct {
+	lock      sync.Mutex
+	hist      [histLevels]uint64
+	once      sync.Once
+	threshold int // The highest intensity level of the black pixels
+}
+
+// An otsuStage is one of the stages of the Otsu threshold.
+type otsuStage struct {
+	state *otsuState
+	phase int
+}
+
+// Create an Otsu threshold, which takes no parameters.
+func newOtsuEffect(params map[string]any) (Effect, error) {
+	return &otsuEffect{}, nil
+}
+
+func (e *otsuEffect) Name() string { return "otsu" }
+
+func (e *otsuEffect) Params() map[string]any { return map[string]any{} }
+
+// The threshold depends on the whole image.
+func (e *otsuEffect) Radius() int { return math.MaxInt32 }
+
+// Apply the threshold to the image slice, from the histogram of the whole image.
+func (e *otsuEffect) Apply(img *Image, start int, end int) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	state := &otsuState{}
+	state.run(otsuHistogram, img, 0, (yMax-yMin)*(xMax-xMin))
+	state.run(otsuMap, img, start, end)
+}
+
+// The histogram is reduced from the histograms of the slices, then every slice is mapped
+// with the threshold, which is computed once by the first slice reaching the second stage.
+func (e *otsuEffect) Stages(img *Image) []Effect {
+	state := &otsuState{}
+	return []Effect{&otsuStage{state, otsuHistogram}, &otsuStage{state, otsuMap}}
+}
+
+func (s *otsuStage) Name() string { return "otsu" }
+
+func (s *otsuStage) Params() map[string]any { return map[string]any{} }
+
+func (s *otsuStage) Radius() int { return 0 }
+
+func (s *otsuStage) Apply(img *Image, start int, end int) {
+	s.state.run(s.phase, img, start, end)
+	if s.phase == otsuHistogram {
+		img.copyThrough(start, end)
+	}
+}
+
+// Run a stage on the image slice from start to end position.
+func (s *otsuState) run(phase int, img *Image, start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	switch phase {
+	case otsuHistogram:
+		// Count the slice in a local histogram, merged once into the shared one.
+		var hist [histLevels]uint64
+		for k := start; k < end; k++ {
+			r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+			// Transparent pixels have no intensity.
+			if a != 0 {
+				hist[intensity(r, g, b, a)>>8]++
+			}
+		}
+		s.lock.Lock()
+		for i, c := range hist {
+			s.hist[i] += c
+		}
+		s.lock.Unlock()
+	case otsuMap:
+		s.once.Do(func() { s.threshold = otsuThreshold(s.hist[:]) })
+		for k := start; k < end; k++ {
+			r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+			v := uint16(0)
+			if int(intensity(r, g, b, a)>>8) > s.threshold {
+				// The output is premultiplied by the alpha of the input.
+				v = uint16(a)
+			}
+			writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), v, v, v, uint16(a))
+		}
+	}
+}
+
+// Return the intensity of a premultiplied pixel, the mean of its channels without premultiplication.
+func intensity(r uint32, g uint32, b uint32, a uint32) uint32 {
+	r, g, b = unpremultiply(r, g, b, a)
+	return (r + g + b) / 3
+}
+
+// Return the level of the histogram that maximizes the variance between the levels up to it
+// and the levels above it.
+func otsuThreshold(hist []uint64) int {
+	var total, sum float64
+	for i, c := range hist {
+		total += float64(c)
+		sum += float64(i) * float64(c)
+	}
+	best, threshold := float64(-1), 0
+	var below, sumBelow float64
+	for i, c := range hist {
+		below += float64(c)
+		sumBelow += float64(i) * float64(c)
+		above := total - below
+		if below == 0 || above == 0 {
+			continue
+		}
+		diff := sumBelow/below - (sum-sumBelow)/above
+		if variance := below * above * diff * diff; variance > best {
+			best, threshold = variance, i
+		}
+	}
+	return threshold
+}
+
+// An adaptiveEffect binarizes each pixel with the weighted mean intensity of its neighbourhood,
+// lowered by an offset. The output is white above the threshold and black elsewhere,
+// with the alpha channel of the input. The intensities are taken without premultiplication,
+// and the neighbourhood mean weights the colors by their alpha. The offset is a fraction of
+// the sRGB intensity, which an image in linear light is thresholded through.
+type adaptiveEffect struct {
+	method string
+	radius int
+	offset float64
+	border Border
+	kernel *Kernel
+}
+
+// Create an adaptive threshold, where "method" weights the neighbourhood with a "mean", the default,
+// or a "gaussian" of standard deviation radius/3, over a window of the given "radius", 7 by default.
+// The "offset" is subtracted from the local mean as a fraction of the largest intensity, 0.02 by default.
+func newAdaptiveEffect(params map[string]any) (Effect, error) {
+	e := &adaptiveEffect{method: "mean"}
+	var err error
+	if e.border, err = paramBorder(params, "border"); err != nil {
+		return nil, err
+	}
+	if v, ok := params["method"]; ok {
+		if e.method, ok = v.(string); !ok {
+			return nil, fmt.Errorf("png: parameter %q must be a string, got %v", "method", v)
+		}
+	}
+	if e.radius, err = paramInt(params, "radius", 7, 1, maxAdaptiveRadius); err != nil {
+		return nil, err
+	}
+	if e.offset, err = paramFloat(params, "offset", 0.02, -1, 1); err != nil {
+		return nil, err
+	}
+	var weights []float64
+	switch e.method {
+	case "mean":
+		weights = make([]float64, 2*e.radius+1)
+		for i := range weights {
+			weights[i] = 1 / float64(len(weights))
+		}
+	case "gaussian":
+		weights = gaussianWindow(float64(e.radius)/3, e.radius)
+	default:
+		return nil, fmt.Errorf("png: unknown adaptive threshold method %q", e.method)
+	}
+	e.kernel = &Kernel{Size: len(weights), Row: weights, Col: weights}
+	return e, nil
+}
+
+func (e *adaptiveEffect) Name() string { return "adaptive" }
+
+func (e *adaptiveEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "method": e.method, "radius": e.radius, "offset": e.offset}
+}
+
+func (e *adaptiveEffect) Radius() int { return e.radius }
+
+// Apply the threshold to the image slice. The local means are first written to the slice of the
+// output buffer, then replaced by the thresholded pixels.
+func (e *adaptiveEffect) Apply(img *Image, start int, end int) {
+	img.PerformKernel(e.kernel, e.border, start, end)
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	offset := e.offset * 0xffff
+	for k := start; k < end; k++ {
+		r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+		mr, mg, mb, ma := readPixel(img.out.Pix, pixOffset(k, n, img.out.Stride))
+		v := uint16(0)
+		if float64(intensity(r, g, b, a)) > float64(intensity(mr, mg, mb, ma))-offset {
+			// The output is premultiplied by the alpha of the input.
+			v = uint16(a)
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), v, v, v, uint16(a))
+	}
+}
@@ -0,0 +1,156 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestOtsuThreshold(t *testing.T) {
+	// Two noisy modes around levels 40 and 200.
+	hist := make([]uint64, histLevels)
+	for i := -5; i <= 5; i++ {
+		hist[40+i] = 100
+		hist[200+i] = 50
+	}
+	if threshold := otsuThreshold(hist); threshold < 45 || threshold >= 195 {
+		t.Errorf("FAILED: otsu threshold %v does not separate the modes", threshold)
+	}
+}
+
+func TestOtsuStages(t *testing.T) {
+	// Dark text strokes on a light page.
+	page := func(x int, y int) uint16 {
+		if x%5 == 0 || y%7 == 0 {
+			return uint16(0x1000 + x*0x80)
+		}
+		return uint16(0xc000 + y*0x100)
+	}
+	effect, _ := NewEffect("otsu", nil)
+	expected := newStepImage(21, 19, page)
+	effect.Apply(expected, 0, 21*19)
+	for y := 0; y < 19; y++ {
+		for x := 0; x < 21; x++ {
+			r, g, b, a := readPixel(expected.out.Pix, expected.out.PixOffset(x, y))
+			if want := page(x, y) >= 0x8000; (r == 0xffff) != want || r != g || g != b || a != 0xffff || (r != 0 && r != 0xffff) {
+				t.Fatalf("FAILED: otsu pixel (%v, %v) is %v, expected white %v", x, y, r, want)
+			}
+		}
+	}
+	for _, chunk := range []int{1, 17, 21 * 19} {
+		img := newStepImage(21, 19, page)
+		applyStages(img, effect, chunk)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: otsu stages differ with chunks of %v pixels", chunk)
+		}
+	}
+}
+
+func TestAdaptiveThreshold(t *testing.T) {
+	// Dark strokes on a page whose lighting fades from left to right,
+	// so that no global threshold separates them.
+	page := func(x int, y int) uint16 {
+		light := 0xf000 - x*0x700
+		if x%6 == 3 {
+			return uint16(light - 0x3000)
+		}
+		return uint16(light)
+	}
+	for _, method := range []string{"mean", "gaussian"} {
+		effect, err := NewEffect("adaptive", map[string]any{"method": method, "radius": 3, "border": "clamp"})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newStepImage(30, 8, page)
+		effect.Apply(img, 0, 30*8)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 30; x++ {
+				r, _, _, _ := readPixel(img.out.Pix, img.out.PixOffset(x, y))
+				if want := x%6 != 3; (r == 0xffff) != want || (r != 0 && r != 0xffff) {
+					t.Fatalf("FAILED: %v adaptive pixel (%v, %v) is %v, expected white %v", method, x, y, r, want)
+				}
+			}
+		}
+	}
+	if _, err := NewEffect("adaptive", map[string]any{"method": "median"}); err == nil {
+		t.Errorf("FAILED: unknown adaptive method accepted")
+	}
+}
+
+func TestTranslucentThresholds(t *testing.T) {
+	// The pages of the Otsu and adaptive tests, translucent, give the same pixels
+	// as the opaque ones, premultiplied by their alpha.
+	cases := []struct {
+		name   string
+		params map[string]any
+		page   func(x int, y int) uint16
+		alpha  func(x int, y int) uint32
+	}{
+		{"otsu", nil, func(x int, y int) uint16 {
+			if x%5 == 0 || y%7 == 0 {
+				return uint16(0x1000 + x*0x80)
+			}
+			return uint16(0xc000 + y*0x100)
+		}, func(x int, y int) uint32 { return uint32(0x4000 + y*0x800) }},
+		{"adaptive", map[string]any{"radius": 3, "border": "clamp"}, func(x int, y int) uint16 {
+			light := 0xf000 - x*0x700
+			if x%6 == 3 {
+				return uint16(light - 0x3000)
+			}
+			return uint16(light)
+		}, func(x int, y int) uint32 { return 0x8000 }},
+	}
+	for _, c := range cases {
+		effect, err := NewEffect(c.name, c.params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		expected := newStepImage(30, 19, c.page)
+		applyStages(expected, effect, 30*19)
+		img := newStepImage(30, 19, c.page)
+		for y := 0; y < 19; y++ {
+			for x := 0; x < 30; x++ {
+				i, a := img.in.PixOffset(x, y), c.alpha(x, y)
+				v, _, _, _ := readPixel(img.in.Pix, i)
+				writePixel(img.in.Pix, i, uint16(v*a/0xffff), uint16(v*a/0xffff), uint16(v*a/0xffff), uint16(a))
+			}
+		}
+		applyStages(img, effect, 37)
+		for y := 0; y < 19; y++ {
+			for x := 0; x < 30; x++ {
+				r, _, _, a := readPixel(img.out.Pix, img.out.PixOffset(x, y))
+				r0, _, _, _ := readPixel(expected.out.Pix, expected.out.PixOffset(x, y))
+				if a != c.alpha(x, y) || r != r0*a/0xffff {
+					t.Fatalf("FAILED: translucent %v pixel (%v, %v) is %x with alpha %x, expected %x", c.name, x, y, r, a, r0*a/0xffff)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeOneBit(t *testing.T) {
+	img := newStepImage(13, 3, func(x int, y int) uint16 {
+		if (x+y)%3 == 0 {
+			return 0xffff
+		}
+		return 0
+	})
+	img.Swap()
+	decoded := roundTrip(t, img, SaveOptions{BitDepth: 1})
+	gray, ok := decoded.(*image.Gray)
+	if !ok {
+		t.Fatalf("FAILED: 1-bit image decoded as %T", decoded)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 13; x++ {
+			if want := (x+y)%3 == 0; (gray.GrayAt(x, y).Y == 0xff) != want {
+				t.Errorf("FAILED: 1-bit pixel (%v, %v) is %v", x, y, gray.GrayAt(x, y).Y)
+			}
+		}
+	}
+
+	writePixel(img.out.Pix, 8, 0x8000, 0x8000, 0x8000, 0xffff)
+	if err := img.encodePNG(&bytes.Buffer{}, SaveOptions{BitDepth: 1}); err != ErrNotBinary {
+		t.Errorf("FAILED: gray pixel saved with 1 bit, error %v", err)
+	}
+}
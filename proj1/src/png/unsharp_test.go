@@ -0,0 +1,102 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnsharp(t *testing.T) {
+	effect, err := NewEffect("unsharp", map[string]any{"radius": 1.5, "amount": 2, "border": "clamp"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if err := ValidateEffect(effect); err != nil {
+		t.Errorf("FAILED: %v", err)
+	}
+
+	// A flat image has no detail to sharpen.
+	flat := newStepImage(9, 7, func(x int, y int) uint16 { return 0x6000 })
+	original := append([]byte(nil), flat.in.Pix...)
+	applyStages(flat, effect, 10)
+	if !bytes.Equal(flat.out.Pix, original) {
+		t.Errorf("FAILED: unsharp mask changes a flat image")
+	}
+
+	// An edge overshoots on both sides.
+	step := func(x int, y int) uint16 {
+		if x < 6 {
+			return 0x4000
+		}
+		return 0xc000
+	}
+	img := newStepImage(12, 5, step)
+	applyStages(img, effect, 12*5)
+	if p := outPixel(img, 5, 2); p[0] >= 0x4000 {
+		t.Errorf("FAILED: dark side of the edge is %v", p)
+	}
+	if p := outPixel(img, 6, 2); p[0] <= 0xc000 || p[3] != 0xffff {
+		t.Errorf("FAILED: bright side of the edge is %v", p)
+	}
+
+	// The stages are independent of the slicing, and close to the unstaged mask.
+	expected := newStepImage(12, 5, step)
+	effect.Apply(expected, 0, 12*5)
+	for _, chunk := range []int{1, 7, 25} {
+		chunked := newStepImage(12, 5, step)
+		applyStages(chunked, effect, chunk)
+		if !bytes.Equal(chunked.out.Pix, img.out.Pix) {
+			t.Errorf("FAILED: unsharp mask differs in chunks of %v", chunk)
+		}
+		for i := 0; i < len(chunked.out.Pix); i += 2 {
+			got := uint32(chunked.out.Pix[i])<<8 | uint32(chunked.out.Pix[i+1])
+			want := uint32(expected.out.Pix[i])<<8 | uint32(expected.out.Pix[i+1])
+			if absDiff(got, want) > 2 {
+				t.Fatalf("FAILED: staged channel %v is %v, unstaged %v", i/2, got, want)
+			}
+		}
+	}
+
+	// A threshold above the contrast of the edge keeps the image.
+	effect, _ = NewEffect("unsharp", map[string]any{"radius": 1.5, "amount": 2, "threshold": 0.6})
+	img = newStepImage(12, 5, step)
+	original = append([]byte(nil), img.in.Pix...)
+	applyStages(img, effect, 9)
+	if !bytes.Equal(img.out.Pix, original) {
+		t.Errorf("FAILED: unsharp mask sharpens below the threshold")
+	}
+
+	invalid := []map[string]any{{"radius": 0}, {"amount": -1}, {"threshold": 2}}
+	for _, params := range invalid {
+		if _, err := NewEffect("unsharp", params); err == nil {
+			t.Errorf("FAILED: unsharp mask with %v should be rejected", params)
+		}
+	}
+}
+
+func TestScratchPlanes(t *testing.T) {
+	// The scratch planes are taken from the pool of the image and given back afterwards.
+	pool := NewPool()
+	img := newTestImage(10, 6)
+	img.pool = pool
+	effect, _ := NewEffect("unsharp", map[string]any{})
+	img.AllocatePlanes(effect)
+	if len(img.planes) != 1 || img.planes[0].Bounds() != img.Bounds {
+		t.Fatalf("FAILED: unsharp mask has the scratch planes %v", img.planes)
+	}
+	img.ReleasePlanes()
+	if img.planes != nil {
+		t.Errorf("FAILED: scratch planes kept after their release")
+	}
+	img.AllocatePlanes(effect)
+	if stats := pool.Stats(); stats.Allocated != 1 || stats.Reused != 1 {
+		t.Errorf("FAILED: released scratch plane not reused, %+v", stats)
+	}
+	img.ReleasePlanes()
+
+	// Other effects take no plane.
+	blur, _ := NewEffect("blur", map[string]any{})
+	img.AllocatePlanes(blur)
+	if img.planes != nil {
+		t.Errorf("FAILED: blur has the scratch planes %v", img.planes)
+	}
+}
@@ -0,0 +1,153 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "warp", Params: []string{"border", "matrix", "inverse", "filter", "width", "height"}, New: newWarpEffect})
+}
+
+// A warpEffect maps the image with an affine transform or a homography, e.g. to deskew a document
+// or to correct a keystone. Each output pixel is interpolated at the position of the input it comes from,
+// so the output pixels are independent. The filter is not widened where the warp shrinks the image.
+type warpEffect struct {
+	matrix        []float64 // The 2x3 or 3x3 row-major matrix from the input to the output pixel coordinates
+	inverse       [9]float64
+	inversed      bool // The matrix maps the output to the input pixel coordinates instead
+	border        Border
+	filter        *filter
+	width, height int // The output size, the input size if 0
+}
+
+// Create a warp by the 6 coefficients of an affine "matrix", or the 9 of a homography, which map the
+// input pixel coordinates to the output ones, or the output ones to the input with "inverse".
+// The "filter" is the one of a resize, bilinear by default, and the output has the given "width" and
+// "height", the size of the input by default. The pixels mapped from outside of the input are read by
+// the border policy, transparent with the zero border.
+func newWarpEffect(params map[string]any) (Effect, error) {
+	e := &warpEffect{}
+	var err error
+	if e.border, err = paramBorder(params, "border"); err != nil {
+		return nil, err
+	}
+	if e.matrix, err = paramFloats(params, "matrix", 6, 9); err != nil {
+		return nil, err
+	}
+	if e.matrix == nil {
+		return nil, errors.New("png: warp effect needs a matrix")
+	}
+	if v, ok := params["inverse"]; ok {
+		if e.inversed, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("png: parameter %q must be a boolean, got %v", "inverse", v)
+		}
+	}
+	if e.filter, err = paramFilter(params, "filter"); err != nil {
+		return nil, err
+	}
+	if e.width, err = paramInt(params, "width", 0, 1, maxImageSize); err != nil {
+		return nil, err
+	}
+	if e.height, err = paramInt(params, "height", 0, 1, maxImageSize); err != nil {
+		return nil, err
+	}
+	var m [9]float64
+	copy(m[:], e.matrix)
+	if len(e.matrix) == 6 {
+		m[8] = 1
+	}
+	if e.inversed {
+		e.inverse = m
+	} else if e.inverse, err = invert3x3(m); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Return the inverse of the 3x3 row-major matrix m.
+func invert3x3(m [9]float64) ([9]float64, error) {
+	cofactors := [9]float64{
+		m[4]*m[8] - m[5]*m[7], m[2]*m[7] - m[1]*m[8], m[1]*m[5] - m[2]*m[4],
+		m[5]*m[6] - m[3]*m[8], m[0]*m[8] - m[2]*m[6], m[2]*m[3] - m[0]*m[5],
+		m[3]*m[7] - m[4]*m[6], m[1]*m[6] - m[0]*m[7], m[0]*m[4] - m[1]*m[3],
+	}
+	det := m[0]*cofactors[0] + m[1]*cofactors[3] + m[2]*cofactors[6]
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return [9]float64{}, errors.New("png: warp matrix is not invertible")
+	}
+	for i := range cofactors {
+		cofactors[i] /= det
+	}
+	return cofactors, nil
+}
+
+func (e *warpEffect) Name() string { return "warp" }
+
+func (e *warpEffect) Params() map[string]any {
+	params := map[string]any{"border": e.border.String(), "matrix": append([]float64(nil), e.matrix...),
+		"inverse": e.inversed, "filter": e.filter.name}
+	if e.width != 0 {
+		params["width"] = e.width
+	}
+	if e.height != 0 {
+		params["height"] = e.height
+	}
+	return params
+}
+
+// A warped pixel may read any pixel of the input.
+func (e *warpEffect) Radius() int { return math.MaxInt32 }
+
+func (e *warpEffect) OutputBounds(in image.Rectangle) image.Rectangle {
+	w, h := in.Dx(), in.Dy()
+	if e.width != 0 {
+		w = e.width
+	}
+	if e.height != 0 {
+		h = e.height
+	}
+	return image.Rect(0, 0, w, h)
+}
+
+// Return the inverse matrix scaled so that the homogeneous coordinate is positive at the center
+// of the output. A matrix and its negation are the same warp, the points where the coordinate has
+// the other sign are behind the horizon of the homography.
+func (e *warpEffect) oriented(out image.Rectangle) [9]float64 {
+	m := e.inverse
+	x, y := float64(out.Dx())/2, float64(out.Dy())/2
+	if m[6]*x+m[7]*y+m[8] < 0 {
+		for i := range m {
+			m[i] = -m[i]
+		}
+	}
+	return m
+}
+
+func (e *warpEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *warpEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Warp the image slice, in the float planes if linear.
+func (e *warpEffect) apply(img *Image, start int, end int, linear bool) {
+	in := img.in.Bounds()
+	m := e.oriented(img.out.Bounds())
+	img.resample(e.filter, e.border, 1, 1, linear, start, end, func(x float64, y float64) (float64, float64, bool) {
+		// Points mapped from behind the horizon of a homography have no input.
+		w := m[6]*x + m[7]*y + m[8]
+		if w <= 0 {
+			return 0, 0, false
+		}
+		sx, sy := (m[0]*x+m[1]*y+m[2])/w, (m[3]*x+m[4]*y+m[5])/w
+		// The sampler puts the center of the pixel (x, y) at (x+0.5, y+0.5).
+		return float64(in.Min.X) + sx + 0.5, float64(in.Min.Y) + sy + 0.5, true
+	})
+}
@@ -0,0 +1,120 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestInvert3x3(t *testing.T) {
+	m := [9]float64{2, 1, 3, 0, 1, -1, 1, 0, 4}
+	inverse, err := invert3x3(m)
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			v := m[i*3]*inverse[j] + m[i*3+1]*inverse[3+j] + m[i*3+2]*inverse[6+j]
+			want := float64(0)
+			if i == j {
+				want = 1
+			}
+			if math.Abs(v-want) > 1e-12 {
+				t.Errorf("FAILED: product with the inverse has %v at (%v, %v)", v, i, j)
+			}
+		}
+	}
+	if _, err := invert3x3([9]float64{1, 2, 0, 2, 4, 0, 0, 0, 1}); err == nil {
+		t.Errorf("FAILED: singular matrix inverted")
+	}
+}
+
+func TestWarp(t *testing.T) {
+	source := newTestImage(11, 8)
+
+	// The identity keeps the image with any filter.
+	for _, filter := range []string{"bilinear", "bicubic"} {
+		effect, err := NewEffect("warp", map[string]any{"matrix": []any{1.0, 0.0, 0.0, 0.0, 1.0, 0.0}, "filter": filter})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		if err := ValidateEffect(effect); err != nil {
+			t.Errorf("FAILED: %v", err)
+		}
+		img := newTestImage(11, 8)
+		applyStages(img, effect, 13)
+		if !bytes.Equal(img.out.Pix, source.in.Pix) {
+			t.Errorf("FAILED: identity %v warp changes the image", filter)
+		}
+	}
+
+	// A negated matrix is the same warp, with or without inverse.
+	for _, inverse := range []bool{false, true} {
+		effect, _ := NewEffect("warp", map[string]any{"matrix": []any{-1.0, 0.0, 0.0, 0.0, -1.0, 0.0, 0.0, 0.0, -1.0}, "inverse": inverse})
+		img := newTestImage(11, 8)
+		applyStages(img, effect, 13)
+		if !bytes.Equal(img.out.Pix, source.in.Pix) {
+			t.Errorf("FAILED: negated identity warp with inverse %v changes the image", inverse)
+		}
+	}
+
+	// A translation moves the pixels, uncovering transparent ones, into an output of the given size.
+	effect, _ := NewEffect("warp", map[string]any{"matrix": []any{1.0, 0.0, 2.0, 0.0, 1.0, -1.0}, "width": 9, "height": 6})
+	img := newTestImage(11, 8)
+	applyStages(img, effect, 13)
+	if img.Bounds != image.Rect(0, 0, 9, 6) {
+		t.Fatalf("FAILED: warped image has bounds %v", img.Bounds)
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 9; x++ {
+			want := [4]uint32{}
+			if x >= 2 {
+				want = inPixel(source, x-2, y+1)
+			}
+			if outPixel(img, x, y) != want {
+				t.Fatalf("FAILED: translated pixel (%v, %v) is %v, expected %v", x, y, outPixel(img, x, y), want)
+			}
+		}
+	}
+
+	// A homography with a constant scale is the affine scale, and an inverse matrix is the same warp.
+	warps := []map[string]any{
+		{"matrix": []any{1.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.5}},
+		{"matrix": []any{0.5, 0.0, 0.0, 0.0, 0.5, 0.0}, "inverse": true},
+	}
+	expected := newTestImage(11, 8)
+	effect, _ = NewEffect("warp", map[string]any{"matrix": []any{2.0, 0.0, 0.0, 0.0, 2.0, 0.0}})
+	applyStages(expected, effect, 88)
+	for _, params := range warps {
+		effect, err := NewEffect("warp", params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newTestImage(11, 8)
+		applyStages(img, effect, 7)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: warp %v differs from the affine scale", params)
+		}
+	}
+
+	if _, err := NewEffect("warp", map[string]any{"matrix": []any{1.0, 2.0, 0.0, 2.0, 4.0, 0.0}}); err == nil {
+		t.Errorf("FAILED: singular warp accepted")
+	}
+}
+
+func TestWarpKeystone(t *testing.T) {
+	// A keystone correction is independent of the slicing, and nothing is read from behind the horizon.
+	keystone := []any{1.0, 0.2, 0.0, 0.0, 1.0, 0.0, 0.0, 0.02, 1.0}
+	effect, err := NewEffect("warp", map[string]any{"matrix": keystone, "filter": "bicubic", "border": "clamp"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	expected := newTestImage(25, 19)
+	applyStages(expected, effect, 25*19)
+	img := newTestImage(25, 19)
+	applyStages(img, effect, 17)
+	if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+		t.Errorf("FAILED: keystone warp differs when chunked")
+	}
+}
@@ -0,0 +1,28 @@
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"proj1/png"
+	"runtime"
+)
+
+// The image buffers shared by all the tasks of a run.
+var buffers = png.NewPool()
+
+// Write the memory usage of the run: the image buffers allocated and reused by the pool,
+// and the heap high-water mark, since the heap reserved by the runtime never shrinks.
+func reportMemory(w io.Writer) {
+	stats := buffers.Stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "buffers: %d allocated, %d reused, %.1f MiB peak in use, %.1f MiB held\n",
+		stats.Allocated, stats.Reused, mebibytes(uint64(stats.PeakBytes)), mebibytes(uint64(stats.HeldBytes)))
+	fmt.Fprintf(w, "heap: %.1f MiB high-water mark, %.1f MiB allocated in total, %d collections\n",
+		mebibytes(mem.HeapSys), mebibytes(mem.TotalAlloc), mem.NumGC)
+}
+
+// Convert a number of bytes to MiB.
+func mebibytes(n uint64) float64 {
+	return float64(n) / (1 << 20)
+}
@@ -13,7 +13,9 @@ import (
 type Node struct {
 	inputFile  string
 	outputFile string
-	effects    []any
+	effects    []png.Effect
+	input      png.LoadOptions
+	output     png.SaveOptions
 	next       *Node
 }
 
@@ -26,34 +28,41 @@ type List struct {
 
 // Process the image task.
 func ProcessTask(task *Node, wg *sync.WaitGroup) {
-	pngImg, err := png.Load(task.inputFile)
+	pngImg, err := png.LoadWithOptions(task.inputFile, task.input)
 	if err != nil {
 		panic(err)
 	}
-	yMin, yMax, xMin, xMax := pngImg.GetBounds()
-	bd := (yMax - yMin) * (xMax - xMin)
-	for _, s := range task.effects {
-		switch s.(string) {
-		case "G":
-			pngImg.Grayscale(0, bd)
-		case "S":
-			pngImg.Sharpen(0, bd)
-		case "E":
-			pngImg.EdgeDetection(0, bd)
-		case "B":
-			pngImg.Blur(0, bd)
+	for _, effect := range task.effects {
+		// Check the effect parameters again before applying it.
+		if err := png.ValidateEffect(effect); err != nil {
+			panic(err)
 		}
-		// swap the in and out image pointer for applying the next effect.
-		pngImg.Swap()
+		// Check the effect applies to the image, e.g. a crop within its bounds.
+		if err := png.CheckEffect(effect, pngImg); err != nil {
+			panic(err)
+		}
+		// Take the scratch planes of the effect, e.g. the original pixels kept by an unsharp mask.
+		pngImg.AllocatePlanes(effect)
+		// Apply each stage of the effect, e.g. the two passes of a separable blur.
+		for _, stage := range png.Stages(effect, pngImg) {
+			// The output buffer takes the bounds of the stage, e.g. of a resized image.
+			bd := pngImg.Prepare(stage)
+			stage.Apply(pngImg, 0, bd)
+			// swap the in and out image pointer for applying the next stage.
+			pngImg.Swap()
+		}
+		pngImg.ReleasePlanes()
 	}
 	// Counteract the last swap.
 	pngImg.Swap()
 	// Save the image.
-	err = pngImg.Save(task.outputFile)
+	err = pngImg.SaveWithOptions(task.outputFile, task.output)
 	// Check save errors.
 	if err != nil {
 		panic(err)
 	}
+	// Return the buffers to the pool for the next image.
+	pngImg.Release()
 }
 
 // Dequeue the list only if the thread get the TAS lock.
@@ -89,31 +98,22 @@ func CreateTaskList(config Config) *List {
 	taskList := &List{head: nil, lock: false, count: 0}
 
 	for {
-		var m map[string]any
-		var inFilePath, outFilePath string
-		var effects []any
-
-		// A non-nil error indicates the end of JSON file.
-		if err := reader.Decode(&m); err != nil {
-			break
+		spec, err := ReadTaskSpec(reader, config)
+		if err != nil {
+			panic(err)
 		}
-		// Get info for a task.
-		for k, v := range m {
-			switch k {
-			case "inPath":
-				inFilePath = v.(string)
-			case "outPath":
-				outFilePath = v.(string)
-			case "effects":
-				effects = v.([]any)
-			}
+		// A nil spec indicates the end of JSON file.
+		if spec == nil {
+			break
 		}
 		for _, dataDir := range dir {
 			// Append the task to the end of the queue.
 			task := &Node{
-				inputFile:  "../data/in/" + dataDir + "/" + inFilePath,
-				outputFile: "../data/out/" + dataDir + "_" + outFilePath,
-				effects:    effects,
+				inputFile:  "../data/in/" + dataDir + "/" + spec.InPath,
+				outputFile: "../data/out/" + dataDir + "_" + spec.OutPath,
+				effects:    spec.Effects,
+				input:      spec.Input,
+				output:     spec.Output,
 				next:       nil}
 			if taskList.head == nil {
 				taskList.head = task
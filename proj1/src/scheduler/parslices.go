@@ -7,17 +7,8 @@ import (
 )
 
 // Process the image slice.
-func SliceChunk(s any, img *png.Image, chunkStart int, chunkEnd int, wg *sync.WaitGroup) {
-	switch s.(string) {
-	case "G":
-		img.Grayscale(chunkStart, chunkEnd)
-	case "S":
-		img.Sharpen(chunkStart, chunkEnd)
-	case "E":
-		img.EdgeDetection(chunkStart, chunkEnd)
-	case "B":
-		img.Blur(chunkStart, chunkEnd)
-	}
+func SliceChunk(effect png.Effect, img *png.Image, chunkStart int, chunkEnd int, wg *sync.WaitGroup) {
+	effect.Apply(img, chunkStart, chunkEnd)
 	wg.Done()
 }
 
@@ -34,47 +25,61 @@ func RunParallelSlices(config Config) {
 		taskList.head = task.next
 
 		// Load image
-		pngImg, err := png.Load(task.inputFile)
+		pngImg, err := png.LoadWithOptions(task.inputFile, task.input)
 		if err != nil {
 			panic(err)
 		}
 
-		// Get image bounds
-		yMin, yMax, xMin, xMax := pngImg.GetBounds()
-
-		// Get number of pixels per thread
-		numPixels := (yMax - yMin) * (xMax - xMin)
 		numThreads := config.ThreadCount
-		numPixelsPerThread := int(math.Ceil(float64(numPixels) / float64(numThreads)))
 
 		// Process each effect sequantially
-		for _, s := range task.effects {
-			var wg sync.WaitGroup
-			// Spawn a go routine for each image slice.
-			for i := 0; i < numThreads; i++ {
-				chunkStart := numPixelsPerThread * i
-				if chunkStart > numPixels {
-					chunkStart = numPixels
-				}
-				chunkEnd := chunkStart + numPixelsPerThread
-				if chunkEnd > numPixels {
-					chunkEnd = numPixels
+		for _, effect := range task.effects {
+			// Check the effect parameters again before applying it.
+			if err := png.ValidateEffect(effect); err != nil {
+				panic(err)
+			}
+			// Check the effect applies to the image, e.g. a crop within its bounds.
+			if err := png.CheckEffect(effect, pngImg); err != nil {
+				panic(err)
+			}
+			// Take the scratch planes of the effect, e.g. the original pixels kept by an unsharp mask.
+			pngImg.AllocatePlanes(effect)
+			// Apply each stage of the effect, e.g. the two passes of a separable blur.
+			for _, stage := range png.Stages(effect, pngImg) {
+				// The slices are taken from the output of the stage, which may change the bounds of the image.
+				numPixels := pngImg.Prepare(stage)
+				// Get number of pixels per thread
+				numPixelsPerThread := int(math.Ceil(float64(numPixels) / float64(numThreads)))
+				var wg sync.WaitGroup
+				// Spawn a go routine for each image slice.
+				for i := 0; i < numThreads; i++ {
+					chunkStart := numPixelsPerThread * i
+					if chunkStart > numPixels {
+						chunkStart = numPixels
+					}
+					chunkEnd := chunkStart + numPixelsPerThread
+					if chunkEnd > numPixels {
+						chunkEnd = numPixels
+					}
+					wg.Add(1)
+					go SliceChunk(stage, pngImg, chunkStart, chunkEnd, &wg)
 				}
-				wg.Add(1)
-				go SliceChunk(s, pngImg, chunkStart, chunkEnd, &wg)
+				// Wait until all slices are done.
+				wg.Wait()
+				// swap the in and out image pointer for applying the next stage.
+				pngImg.Swap()
 			}
-			// Wait until all slices are done.
-			wg.Wait()
-			// swap the in and out image pointer for applying the next effect.
-			pngImg.Swap()
+			pngImg.ReleasePlanes()
 		}
 		// Counteract the last swap.
 		pngImg.Swap()
 		// Save the image.
-		err = pngImg.Save(task.outputFile)
+		err = pngImg.SaveWithOptions(task.outputFile, task.output)
 		// Check save errors.
 		if err != nil {
 			panic(err)
 		}
+		// Return the buffers to the pool for the next image.
+		pngImg.Release()
 	}
 }
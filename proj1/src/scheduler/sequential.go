@@ -16,64 +16,57 @@ func RunSequential(config Config) {
 	dir := strings.Split(config.DataDirs, "+")
 
 	for {
-		var m map[string]interface{}
-		var inFilePath, outFilePath string
-		var effects []interface{}
-
-		// An error indicates the end of JSON file.
+		spec, err := ReadTaskSpec(reader, config)
+		if err != nil {
+			panic(err)
+		}
+		// A nil spec indicates the end of JSON file.
 		// Return, since all tasks are done.
-		if err := reader.Decode(&m); err != nil {
+		if spec == nil {
 			return
 		}
 
-		// Get image task info.
-		for k, v := range m {
-			switch k {
-			case "inPath":
-				inFilePath = v.(string)
-			case "outPath":
-				outFilePath = v.(string)
-			case "effects":
-				effects = v.([]interface{})
-			}
-		}
-
 		// Process image task.
 		for _, dataDir := range dir {
-			pngImg, err := png.Load("../data/in/" + dataDir + "/" + inFilePath)
+			pngImg, err := png.LoadWithOptions("../data/in/"+dataDir+"/"+spec.InPath, spec.Input)
 
 			if err != nil {
 				panic(err)
 			}
-			// Get image bounds.
-			yMin, yMax, xMin, xMax := pngImg.GetBounds()
-			// Set start position to 0 and end position to the end of the image.
-			bd := (yMax - yMin) * (xMax - xMin)
-
-			for _, s := range effects {
-				switch s.(string) {
-				case "G":
-					pngImg.Grayscale(0, bd)
-				case "S":
-					pngImg.Sharpen(0, bd)
-				case "E":
-					pngImg.EdgeDetection(0, bd)
-				case "B":
-					pngImg.Blur(0, bd)
+			for _, effect := range spec.Effects {
+				// Check the effect parameters again before applying it.
+				if err := png.ValidateEffect(effect); err != nil {
+					panic(err)
+				}
+				// Check the effect applies to the image, e.g. a crop within its bounds.
+				if err := png.CheckEffect(effect, pngImg); err != nil {
+					panic(err)
+				}
+				// Take the scratch planes of the effect, e.g. the original pixels kept by an unsharp mask.
+				pngImg.AllocatePlanes(effect)
+				// Apply each stage of the effect, e.g. the two passes of a separable blur.
+				for _, stage := range png.Stages(effect, pngImg) {
+					// The output buffer takes the bounds of the stage, e.g. of a resized image.
+					// Set start position to 0 and end position to the end of the image.
+					bd := pngImg.Prepare(stage)
+					stage.Apply(pngImg, 0, bd)
+					// swap the in and out image pointer for applying the next stage.
+					pngImg.Swap()
 				}
-				// swap the in and out image pointer for applying the next effect.
-				pngImg.Swap()
+				pngImg.ReleasePlanes()
 			}
 
 			// Counteract the last swap.
 			pngImg.Swap()
 			// Save the image.
-			err = pngImg.Save("../data/out/" + dataDir + "_" + outFilePath)
+			err = pngImg.SaveWithOptions("../data/out/"+dataDir+"_"+spec.OutPath, spec.Output)
 
 			//Checks save errors.
 			if err != nil {
 				panic(err)
 			}
+			// Return the buffers to the pool for the next image.
+			pngImg.Release()
 		}
 	}
 }
@@ -0,0 +1,30 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReadTaskSpecMalformed(t *testing.T) {
+	// A malformed line fails instead of ending the task list.
+	lines := `{"inPath": "a.png", "outPath": "a_out.png", "effects": ["G"]}
+{"inPath": "b.png", "outPath": "b_out.png", "effects": ["G",]}
+{"inPath": "c.png", "outPath": "c_out.png", "effects": ["G"]}
+`
+	reader := json.NewDecoder(strings.NewReader(lines))
+	config := Config{ThreadCount: 1}
+	if spec, err := ReadTaskSpec(reader, config); err != nil || spec == nil || spec.InPath != "a.png" {
+		t.Fatalf("FAILED: first task is %v with error %v", spec, err)
+	}
+	if spec, err := ReadTaskSpec(reader, config); err == nil {
+		t.Errorf("FAILED: malformed task read as %v", spec)
+	}
+
+	// The end of the file gives no task and no error.
+	reader = json.NewDecoder(strings.NewReader(lines[:strings.Index(lines, "\n")+1]))
+	ReadTaskSpec(reader, config)
+	if spec, err := ReadTaskSpec(reader, config); spec != nil || err != nil {
+		t.Errorf("FAILED: end of file read as %v with error %v", spec, err)
+	}
+}
@@ -0,0 +1,326 @@
+// Package bmp implements a BMP image decoder and encoder.
+//
+// The decoder supports uncompressed 1, 4, 8, 24 and 32 bits per pixel images,
+// as well as 32 bits per pixel images with bit field masks.
+// The encoder writes 24 bits per pixel images if the image is opaque
+// and 32 bits per pixel images with an alpha mask otherwise.
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+const (
+	fileHeaderLen = 14
+	infoHeaderLen = 40  // BITMAPINFOHEADER
+	v4HeaderLen   = 108 // BITMAPV4HEADER
+
+	compressionRGB       = 0
+	compressionBitFields = 3
+
+	maxDimension = 1 << 16 // The largest width or height decoded
+)
+
+// ErrUnsupported means that the input BMP image uses a valid but unsupported feature.
+var ErrUnsupported = errors.New("bmp: unsupported BMP image")
+
+// The header fields needed for decoding.
+type header struct {
+	pixOffset   uint32
+	width       int
+	height      int
+	topDown     bool
+	bpp         int
+	compression uint32
+	masks       [4]uint32 // red, green, blue and alpha masks of bit field images
+	numColors   int
+	headerLen   uint32
+}
+
+func init() {
+	image.RegisterFormat("bmp", "BM????\x00\x00\x00\x00", Decode, DecodeConfig)
+}
+
+// Read the file and info headers, and the color palette of paletted images.
+func readHeader(r io.Reader) (header, color.Palette, error) {
+	var h header
+	var buf [fileHeaderLen + 4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return h, nil, err
+	}
+	if string(buf[:2]) != "BM" {
+		return h, nil, errors.New("bmp: invalid format")
+	}
+	h.pixOffset = binary.LittleEndian.Uint32(buf[10:14])
+	h.headerLen = binary.LittleEndian.Uint32(buf[14:18])
+	if h.headerLen < infoHeaderLen || h.headerLen > 1024 {
+		return h, nil, ErrUnsupported
+	}
+	info := make([]byte, h.headerLen-4)
+	if _, err := io.ReadFull(r, info); err != nil {
+		return h, nil, err
+	}
+	// The height of a top-down image is negative.
+	h.width = int(int32(binary.LittleEndian.Uint32(info[0:4])))
+	h.height = int(int32(binary.LittleEndian.Uint32(info[4:8])))
+	if h.height < 0 {
+		h.height, h.topDown = -h.height, true
+	}
+	if h.width <= 0 || h.width > maxDimension || h.height <= 0 || h.height > maxDimension {
+		return h, nil, errors.New("bmp: invalid image size")
+	}
+	if planes := binary.LittleEndian.Uint16(info[8:10]); planes != 1 {
+		return h, nil, ErrUnsupported
+	}
+	h.bpp = int(binary.LittleEndian.Uint16(info[10:12]))
+	h.compression = binary.LittleEndian.Uint32(info[12:16])
+	h.numColors = int(binary.LittleEndian.Uint32(info[28:32]))
+
+	switch {
+	case h.compression == compressionRGB && (h.bpp == 1 || h.bpp == 4 || h.bpp == 8 || h.bpp == 24 || h.bpp == 32):
+	case h.compression == compressionBitFields && h.bpp == 32:
+		// The masks follow the info header, or are part of a V2 or later header.
+		var masks [16]byte
+		if h.headerLen >= infoHeaderLen+12 {
+			copy(masks[:], info[infoHeaderLen-4:])
+		} else {
+			if _, err := io.ReadFull(r, masks[:12]); err != nil {
+				return h, nil, err
+			}
+			h.headerLen += 12
+		}
+		for i := range h.masks {
+			h.masks[i] = binary.LittleEndian.Uint32(masks[i*4:])
+		}
+	default:
+		return h, nil, ErrUnsupported
+	}
+	if h.bpp > 8 {
+		return h, nil, nil
+	}
+	// Read the palette of a paletted image.
+	if h.numColors == 0 || h.numColors > 1<<h.bpp {
+		h.numColors = 1 << h.bpp
+	}
+	raw := make([]byte, h.numColors*4)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return h, nil, err
+	}
+	h.headerLen += uint32(len(raw))
+	palette := make(color.Palette, h.numColors)
+	for i := range palette {
+		// Each palette entry is stored as blue, green, red, reserved.
+		palette[i] = color.RGBA{raw[i*4+2], raw[i*4+1], raw[i*4], 0xff}
+	}
+	return h, palette, nil
+}
+
+// Return the length of a row of the pixel array, which is padded to a multiple of 4 bytes.
+func (h header) rowLen() int {
+	return (h.width*h.bpp + 31) / 32 * 4
+}
+
+// DecodeConfig returns the color model and dimensions of a BMP image without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, palette, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if palette != nil {
+		return image.Config{ColorModel: palette, Width: h.width, Height: h.height}, nil
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: h.width, Height: h.height}, nil
+}
+
+// Decode reads a BMP image from r and returns it as an image.Image.
+func Decode(r io.Reader) (image.Image, error) {
+	h, palette, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// Skip to the pixel array.
+	if skip := int64(h.pixOffset) - int64(fileHeaderLen+h.headerLen); skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			return nil, err
+		}
+	} else if skip < 0 {
+		return nil, errors.New("bmp: invalid pixel array offset")
+	}
+
+	// The pixel array is read before the image is allocated, so that a forged header cannot make
+	// the decoder allocate a huge image for a short input. The file size of the header is ignored,
+	// as it may be 0.
+	pixels, err := readPixelArray(r, int64(h.rowLen())*int64(h.height))
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows are padded to a multiple of 4 bytes and stored bottom-up unless the height is negative.
+	rect := image.Rect(0, 0, h.width, h.height)
+	var paletted *image.Paletted
+	var nrgba *image.NRGBA
+	if palette != nil {
+		paletted = image.NewPaletted(rect, palette)
+	} else {
+		nrgba = image.NewNRGBA(rect)
+	}
+	for i := 0; i < h.height; i++ {
+		row := pixels[i*h.rowLen() : (i+1)*h.rowLen()]
+		y := h.height - 1 - i
+		if h.topDown {
+			y = i
+		}
+		switch {
+		case paletted != nil:
+			pix := paletted.Pix[y*paletted.Stride : y*paletted.Stride+h.width]
+			perByte := 8 / h.bpp
+			for x := range pix {
+				shift := uint(8 - h.bpp*(x%perByte+1))
+				index := (row[x/perByte] >> shift) & (1<<h.bpp - 1)
+				if int(index) >= len(palette) {
+					index = 0
+				}
+				pix[x] = index
+			}
+		case h.bpp == 24:
+			pix := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+h.width*4]
+			for x := 0; x < h.width; x++ {
+				pix[x*4], pix[x*4+1], pix[x*4+2], pix[x*4+3] = row[x*3+2], row[x*3+1], row[x*3], 0xff
+			}
+		case h.compression == compressionRGB:
+			// 32 bits per pixel without masks, where the fourth byte is unused.
+			pix := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+h.width*4]
+			for x := 0; x < h.width; x++ {
+				pix[x*4], pix[x*4+1], pix[x*4+2], pix[x*4+3] = row[x*4+2], row[x*4+1], row[x*4], 0xff
+			}
+		default:
+			pix := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+h.width*4]
+			for x := 0; x < h.width; x++ {
+				v := binary.LittleEndian.Uint32(row[x*4:])
+				for c, mask := range h.masks {
+					pix[x*4+c] = maskedValue(v, mask)
+				}
+				if h.masks[3] == 0 {
+					pix[x*4+3] = 0xff
+				}
+			}
+		}
+	}
+	if paletted != nil {
+		return paletted, nil
+	}
+	return nrgba, nil
+}
+
+// Read the pixel array of n bytes from r. The buffer grows with the data actually read,
+// up to twice its size.
+func readPixelArray(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Extract the masked bits of v scaled to 8 bits.
+func maskedValue(v uint32, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift, bits := 0, 0
+	for mask&1 == 0 {
+		mask >>= 1
+		shift++
+	}
+	for mask&1 == 1 {
+		mask >>= 1
+		bits++
+	}
+	value := (v >> uint(shift)) & (1<<uint(bits) - 1)
+	if bits >= 8 {
+		return uint8(value >> uint(bits-8))
+	}
+	// Replicate the high bits to fill the low bits, e.g. 5-bit 0x1f becomes 0xff.
+	return uint8(value * 0xff / (1<<uint(bits) - 1))
+}
+
+// Encode writes the image m to w in BMP format.
+func Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	opaque := isOpaque(m)
+
+	bpp, headerLen := 32, v4HeaderLen
+	if opaque {
+		bpp, headerLen = 24, infoHeaderLen
+	}
+	rowLen := (width*bpp + 31) / 32 * 4
+	pixOffset := fileHeaderLen + headerLen
+	fileLen := pixOffset + rowLen*height
+
+	hdr := make([]byte, pixOffset)
+	hdr[0], hdr[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(hdr[2:], uint32(fileLen))
+	binary.LittleEndian.PutUint32(hdr[10:], uint32(pixOffset))
+	info := hdr[fileHeaderLen:]
+	binary.LittleEndian.PutUint32(info[0:], uint32(headerLen))
+	binary.LittleEndian.PutUint32(info[4:], uint32(width))
+	binary.LittleEndian.PutUint32(info[8:], uint32(height))
+	binary.LittleEndian.PutUint16(info[12:], 1)
+	binary.LittleEndian.PutUint16(info[14:], uint16(bpp))
+	binary.LittleEndian.PutUint32(info[20:], uint32(rowLen*height))
+	binary.LittleEndian.PutUint32(info[24:], 2835) // 72 DPI
+	binary.LittleEndian.PutUint32(info[28:], 2835)
+	if !opaque {
+		binary.LittleEndian.PutUint32(info[16:], compressionBitFields)
+		binary.LittleEndian.PutUint32(info[40:], 0x00ff0000) // red
+		binary.LittleEndian.PutUint32(info[44:], 0x0000ff00) // green
+		binary.LittleEndian.PutUint32(info[48:], 0x000000ff) // blue
+		binary.LittleEndian.PutUint32(info[52:], 0xff000000) // alpha
+		copy(info[56:], "BGRs")                              // sRGB color space
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	// Write the rows bottom-up.
+	row := make([]byte, rowLen)
+	for y := b.Max.Y - 1; y >= b.Min.Y; y-- {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			i := (x - b.Min.X) * bpp / 8
+			row[i], row[i+1], row[i+2] = c.B, c.G, c.R
+			if !opaque {
+				row[i+3] = c.A
+			}
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report whether every pixel of m is fully opaque.
+func isOpaque(m image.Image) bool {
+	if o, ok := m.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import "math"
+
+// The largest factors of the color adjustments.
+const (
+	maxContrastFactor   = 10
+	maxSaturationFactor = 10
+	maxGamma            = 10
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "brightness", Params: []string{"amount"}, New: newBrightnessEffect})
+	RegisterEffect(EffectSpec{Name: "contrast", Params: []string{"factor"}, New: newContrastEffect})
+	RegisterEffect(EffectSpec{Name: "gamma", Params: []string{"gamma"}, New: newGammaEffect})
+	RegisterEffect(EffectSpec{Name: "saturation", Params: []string{"factor"}, New: newSaturationEffect})
+	RegisterEffect(EffectSpec{Name: "hue", Params: []string{"degrees"}, New: newHueEffect})
+}
+
+// A colorEffect maps the color of each pixel independently of its neighbours.
+// The mapping works on non-premultiplied rgb channels within [0, 1], and its result
+// is clamped to that range. The alpha channel is kept. The channels of an image
+// in linear light are mapped as linear light.
+type colorEffect struct {
+	name   string
+	params map[string]any
+	fn     func(r float64, g float64, b float64) (float64, float64, float64)
+}
+
+func (e *colorEffect) Name() string { return e.name }
+
+func (e *colorEffect) Params() map[string]any {
+	params := map[string]any{}
+	for k, v := range e.params {
+		params[k] = v
+	}
+	return params
+}
+
+func (e *colorEffect) Radius() int { return 0 }
+
+func (e *colorEffect) Apply(img *Image, start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	for k := start; k < end; k++ {
+		r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+		r, g, b = unpremultiply(r, g, b, a)
+		rf, gf, bf := e.fn(float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff)
+		// The output is premultiplied by the alpha of the input.
+		r, g, b = unitChannel(rf)*a/0xffff, unitChannel(gf)*a/0xffff, unitChannel(bf)*a/0xffff
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), uint16(r), uint16(g), uint16(b), uint16(a))
+	}
+}
+
+func (e *colorEffect) ApplyLinear(img *Image, start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	for k := start; k < end; k++ {
+		r, g, b, a := readFloat(img.fin.Pix, floatOffset(k, n, img.fin.Stride))
+		if a > 0 {
+			r, g, b = e.fn(r/a, g/a, b/a)
+		}
+		// The output is premultiplied by the alpha of the input.
+		r, g, b = math.Max(0, math.Min(r, 1))*a, math.Max(0, math.Min(g, 1))*a, math.Max(0, math.Min(b, 1))*a
+		writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride), r, g, b, a)
+	}
+}
+
+// Return the 16-bit channel of the value within [0, 1], rounded to the nearest.
+func unitChannel(v float64) uint32 {
+	return uint32(clamp(v*0xffff + 0.5))
+}
+
+// Create a brightness adjustment, which adds "amount" within [-1, 1] to each channel, 0 by default.
+func newBrightnessEffect(params map[string]any) (Effect, error) {
+	amount, err := paramFloat(params, "amount", 0, -1, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &colorEffect{name: "brightness", params: map[string]any{"amount": amount},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			return r + amount, g + amount, b + amount
+		}}, nil
+}
+
+// Create a contrast adjustment, which scales the distance of each channel to the middle gray
+// by "factor", 1 by default.
+func newContrastEffect(params map[string]any) (Effect, error) {
+	factor, err := paramFloat(params, "factor", 1, 0, maxContrastFactor)
+	if err != nil {
+		return nil, err
+	}
+	return &colorEffect{name: "contrast", params: map[string]any{"factor": factor},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			return (r-0.5)*factor + 0.5, (g-0.5)*factor + 0.5, (b-0.5)*factor + 0.5
+		}}, nil
+}
+
+// Create a gamma correction, which raises each channel to the power 1/"gamma", 1 by default.
+// A gamma above 1 brightens the midtones.
+func newGammaEffect(params map[string]any) (Effect, error) {
+	gamma, err := paramFloat(params, "gamma", 1, 1.0/maxGamma, maxGamma)
+	if err != nil {
+		return nil, err
+	}
+	return &colorEffect{name: "gamma", params: map[string]any{"gamma": gamma},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			return math.Pow(r, 1/gamma), math.Pow(g, 1/gamma), math.Pow(b, 1/gamma)
+		}}, nil
+}
+
+// Create a saturation adjustment, which scales the HSL saturation by "factor", 1 by default.
+// A factor of 0 turns the image to shades of gray.
+func newSaturationEffect(params map[string]any) (Effect, error) {
+	factor, err := paramFloat(params, "factor", 1, 0, maxSaturationFactor)
+	if err != nil {
+		return nil, err
+	}
+	return &colorEffect{name: "saturation", params: map[string]any{"factor": factor},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			h, s, l := rgbToHSL(r, g, b)
+			return hslToRGB(h, math.Min(s*factor, 1), l)
+		}}, nil
+}
+
+// Create a hue rotation, which turns the HSV hue by "degrees" within [-360, 360], 0 by default.
+func newHueEffect(params map[string]any) (Effect, error) {
+	degrees, err := paramFloat(params, "degrees", 0, -360, 360)
+	if err != nil {
+		return nil, err
+	}
+	return &colorEffect{name: "hue", params: map[string]any{"degrees": degrees},
+		fn: func(r float64, g float64, b float64) (float64, float64, float64) {
+			h, s, v := rgbToHSV(r, g, b)
+			return hsvToRGB(math.Mod(h+degrees+360, 360), s, v)
+		}}, nil
+}
+
+// Return the hue in degrees within [0, 360) and the chroma of rgb channels within [0, 1],
+// with their largest and smallest channels.
+func hueChroma(r float64, g float64, b float64) (float64, float64, float64, float64) {
+	hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	c := hi - lo
+	var h float64
+	switch {
+	case c == 0:
+		h = 0
+	case hi == r:
+		h = math.Mod((g-b)/c+6, 6)
+	case hi == g:
+		h = (b-r)/c + 2
+	default:
+		h = (r-g)/c + 4
+	}
+	return h * 60, c, hi, lo
+}
+
+// Return the rgb channels of the given hue in degrees and chroma, plus m on every channel.
+func hueToRGB(h float64, c float64, m float64) (float64, float64, float64) {
+	hp := h / 60
+	x := c * (1 - math.Abs(math.Mod(hp, 2)-1))
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g, b = c, x, 0
+	case hp < 2:
+		r, g, b = x, c, 0
+	case hp < 3:
+		r, g, b = 0, c, x
+	case hp < 4:
+		r, g, b = 0, x, c
+	case hp < 5:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+// Convert rgb channels within [0, 1] to hue in degrees, saturation and lightness.
+func rgbToHSL(r float64, g float64, b float64) (float64, float64, float64) {
+	h, c, hi, lo := hueChroma(r, g, b)
+	l := (hi + lo) / 2
+	s := float64(0)
+	if l > 0 && l < 1 {
+		s = c / (1 - math.Abs(2*l-1))
+	}
+	return h, s, l
+}
+
+// Convert hue in degrees, saturation and lightness to rgb channels within [0, 1].
+func hslToRGB(h float64, s float64, l float64) (float64, float64, float64) {
+	c := (1 - math.Abs(2*l-1)) * s
+	return hueToRGB(h, c, l-c/2)
+}
+
+// Convert rgb channels within [0, 1] to hue in degrees, saturation and value.
+func rgbToHSV(r float64, g float64, b float64) (float64, float64, float64) {
+	h, c, hi, _ := hueChroma(r, g, b)
+	s := float64(0)
+	if hi > 0 {
+		s = c / hi
+	}
+	return h, s, hi
+}
+
+// Convert hue in degrees, saturation and value to rgb channels within [0, 1].
+func hsvToRGB(h float64, s float64, v float64) (float64, float64, float64) {
+	c := v * s
+	return hueToRGB(h, c, v-c)
+}
@@ -0,0 +1,77 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import "fmt"
+
+// A Border is the policy for reading neighbours that fall outside of the image bounds.
+type Border int
+
+const (
+	BorderZero        Border = iota // Neighbours outside of the image are zero
+	BorderClamp                     // Neighbours are clamped to the nearest edge pixel
+	BorderMirror                    // Neighbours are reflected about the edge pixel
+	BorderWrap                      // Neighbours wrap around to the opposite edge
+	BorderRenormalize               // Neighbours are skipped and the result is rescaled by the weights used
+)
+
+var borderNames = []string{"zero", "clamp", "mirror", "wrap", "renormalize"}
+
+// ParseBorder returns the border policy with the given name as used in effects.txt.
+func ParseBorder(name string) (Border, error) {
+	for i, borderName := range borderNames {
+		if name == borderName {
+			return Border(i), nil
+		}
+	}
+	return BorderZero, fmt.Errorf("png: unknown border mode %q", name)
+}
+
+// String returns the name of the border policy.
+func (b Border) String() string {
+	if b < 0 || int(b) >= len(borderNames) {
+		return fmt.Sprintf("Border(%d)", int(b))
+	}
+	return borderNames[b]
+}
+
+// Map the coordinate i to the range [lo, hi) according to the border policy.
+// Return false if the neighbour should be skipped.
+func (b Border) index(i int, lo int, hi int) (int, bool) {
+	if lo <= i && i < hi {
+		return i, true
+	}
+	n := hi - lo
+	switch b {
+	case BorderClamp:
+		if i < lo {
+			return lo, true
+		}
+		return hi - 1, true
+	case BorderMirror:
+		if n == 1 {
+			return lo, true
+		}
+		// Reflect without repeating the edge pixel, e.g. 2 1 | 0 1 2 ... n-1 | n-2 n-3.
+		period := 2 * (n - 1)
+		k := ((i-lo)%period + period) % period
+		if k >= n {
+			k = period - k
+		}
+		return lo + k, true
+	case BorderWrap:
+		return lo + ((i-lo)%n+n)%n, true
+	}
+	return i, false
+}
+
+// Fill offs with the Pix offsets of the coordinates from first to first+len(offs)-1,
+// mapped to the range [lo, hi) and scaled by step. Skipped neighbours have offset -1.
+func (b Border) offsets(offs []int, first int, lo int, hi int, step int) {
+	for i := range offs {
+		offs[i] = -1
+		if j, ok := b.index(first+i, lo, hi); ok {
+			offs[i] = (j - lo) * step
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"fmt"
+	"math"
+)
+
+// The largest radius of the box blur.
+const maxBoxBlurRadius = 10000
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "boxblur", Params: []string{"border", "radius"}, New: newBoxBlurEffect})
+}
+
+// A boxBlurEffect averages the (2*radius+1) x (2*radius+1) neighbourhood of each pixel
+// through a summed-area table, so its cost per pixel does not depend on the radius.
+type boxBlurEffect struct {
+	radius int
+	border Border
+}
+
+// A summedArea is the summed-area table of the rgba channels of the image rows from y0 to y1,
+// where each entry holds the sums of the pixels above and to the left of it, inclusive.
+// The sums of 16-bit channels are exact in float64, the sums of float planes are not rounded.
+type summedArea struct {
+	table  []float64 // 4 sums per pixel in row-major order
+	y0, y1 int
+	xMin   int
+	n      int // The number of pixels in a row
+}
+
+// The summed-area table of an image shared by the stages of a box blur.
+type boxBlurState struct {
+	effect *boxBlurEffect
+	sat    *summedArea
+	totals [][]float64 // The last row of each block of rows summed by the first stage, indexed by row
+}
+
+// A boxBlurStage is one of the stages of the box blur, which are
+// 0: the summed-area table of each block of rows owned by the slice,
+// 1: the sums of the blocks above each row added to it,
+// 2: the box averages read from the table.
+type boxBlurStage struct {
+	state *boxBlurState
+	phase int
+}
+
+// Create a box blur with the "radius" parameter, 1 by default. Only the zero and renormalize
+// borders are supported, where neighbours outside of the image count as zero or are skipped.
+func newBoxBlurEffect(params map[string]any) (Effect, error) {
+	border, err := paramBorder(params, "border")
+	if err != nil {
+		return nil, err
+	}
+	if border != BorderZero && border != BorderRenormalize {
+		return nil, fmt.Errorf("png: effect \"boxblur\" does not support the %v border", border)
+	}
+	radius, err := paramInt(params, "radius", 1, 1, maxBoxBlurRadius)
+	if err != nil {
+		return nil, err
+	}
+	return &boxBlurEffect{radius: radius, border: border}, nil
+}
+
+func (e *boxBlurEffect) Name() string { return "boxblur" }
+
+func (e *boxBlurEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "radius": e.radius}
+}
+
+func (e *boxBlurEffect) Radius() int { return e.radius }
+
+// Apply the box blur to the image slice at once, through the table of the rows it reads from.
+func (e *boxBlurEffect) Apply(img *Image, start int, end int) {
+	e.apply(img, start, end, false)
+}
+
+func (e *boxBlurEffect) ApplyLinear(img *Image, start int, end int) {
+	e.apply(img, start, end, true)
+}
+
+// Apply the box blur to the image slice at once, in the float planes if linear.
+func (e *boxBlurEffect) apply(img *Image, start int, end int, linear bool) {
+	if start >= end {
+		return
+	}
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	y0, y1 := start/n+yMin-e.radius, (end-1)/n+yMin+e.radius+1
+	if y0 < yMin {
+		y0 = yMin
+	}
+	if y1 > yMax {
+		y1 = yMax
+	}
+	sat := newSummedArea(y0, y1, xMin, n)
+	sat.accumulate(img, y0, y1, linear)
+	e.filter(img, sat, start, end, linear)
+}
+
+// The stages build the summed-area table of the whole image with a parallel prefix sum.
+// Each slice owns the rows starting within it, which are summed independently in the first stage.
+// The second stage adds to each row the column sums of the blocks ending above it, so the slices
+// of the two stages need not match.
+func (e *boxBlurEffect) Stages(img *Image) []Effect {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	state := &boxBlurState{
+		effect: e,
+		sat:    newSummedArea(yMin, yMax, xMin, xMax-xMin),
+		totals: make([][]float64, yMax-yMin),
+	}
+	return []Effect{&boxBlurStage{state, 0}, &boxBlurStage{state, 1}, &boxBlurStage{state, 2}}
+}
+
+func (s *boxBlurStage) Name() string { return s.state.effect.Name() }
+
+func (s *boxBlurStage) Params() map[string]any {
+	return s.state.effect.Params()
+}
+
+func (s *boxBlurStage) Radius() int {
+	if s.phase == 2 {
+		return s.state.effect.radius
+	}
+	return 0
+}
+
+func (s *boxBlurStage) Apply(img *Image, start int, end int) {
+	s.apply(img, start, end, false)
+}
+
+func (s *boxBlurStage) ApplyLinear(img *Image, start int, end int) {
+	s.apply(img, start, end, true)
+}
+
+// Apply the stage to the image slice, in the float planes if linear.
+func (s *boxBlurStage) apply(img *Image, start int, end int, linear bool) {
+	if start >= end {
+		return
+	}
+	sat := s.state.sat
+	// The rows starting within the slice.
+	y0, y1 := (start+sat.n-1)/sat.n+sat.y0, (end+sat.n-1)/sat.n+sat.y0
+	switch s.phase {
+	case 0:
+		if y0 < y1 {
+			sat.accumulate(img, y0, y1, linear)
+			// Keep the column sums of the block, the last row is updated by the next stage.
+			last := sat.row(y1 - 1)
+			s.state.totals[y1-1-sat.y0] = append([]float64(nil), last...)
+		}
+		s.copyThrough(img, start, end, linear)
+	case 1:
+		if y0 < y1 {
+			carry := make([]float64, 4*sat.n)
+			for _, total := range s.state.totals[:y0-sat.y0] {
+				for i, v := range total {
+					carry[i] += v
+				}
+			}
+			// A block of the first stage may end within the slice, its sums carry to the rows below.
+			for y := y0; y < y1; y++ {
+				row := sat.row(y)
+				for i, v := range carry {
+					row[i] += v
+				}
+				for i, v := range s.state.totals[y-sat.y0] {
+					carry[i] += v
+				}
+			}
+		}
+		s.copyThrough(img, start, end, linear)
+	case 2:
+		s.state.effect.filter(img, sat, start, end, linear)
+	}
+}
+
+// Copy the image slice through the buffers, or through the float planes if linear.
+func (s *boxBlurStage) copyThrough(img *Image, start int, end int, linear bool) {
+	if linear {
+		img.copyThroughLinear(start, end)
+	} else {
+		img.copyThrough(start, end)
+	}
+}
+
+// Return an empty summed-area table of the rows from y0 to y1.
+func newSummedArea(y0 int, y1 int, xMin int, n int) *summedArea {
+	return &summedArea{table: make([]float64, (y1-y0)*n*4), y0: y0, y1: y1, xMin: xMin, n: n}
+}
+
+// Return the sums of the row y.
+func (sat *summedArea) row(y int) []float64 {
+	return sat.table[(y-sat.y0)*sat.n*4 : (y-sat.y0+1)*sat.n*4]
+}
+
+// Fill the table of the rows from y0 to y1 with the sums of the pixels of these rows only,
+// read from the input plane if linear.
+func (sat *summedArea) accumulate(img *Image, y0 int, y1 int, linear bool) {
+	yMin, _, _, _ := img.GetBounds()
+	var above []float64
+	for y := y0; y < y1; y++ {
+		row := sat.row(y)
+		var rSum, gSum, bSum, aSum float64
+		for x := 0; x < sat.n; x++ {
+			var r, g, b, a float64
+			if linear {
+				r, g, b, a = readFloat(img.fin.Pix, (y-yMin)*img.fin.Stride+x*4)
+			} else {
+				r16, g16, b16, a16 := readPixel(img.in.Pix, (y-yMin)*img.in.Stride+x*8)
+				r, g, b, a = float64(r16), float64(g16), float64(b16), float64(a16)
+			}
+			rSum += r
+			gSum += g
+			bSum += b
+			aSum += a
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = rSum, gSum, bSum, aSum
+			if above != nil {
+				for c := 0; c < 4; c++ {
+					row[x*4+c] += above[x*4+c]
+				}
+			}
+		}
+		above = row
+	}
+}
+
+// Return the sums of the pixels in the rectangle from (x1, y1) to (x2, y2) inclusive,
+// which must be within the columns of the image and the rows of the table.
+func (sat *summedArea) rect(x1 int, y1 int, x2 int, y2 int) (float64, float64, float64, float64) {
+	var sums [4]float64
+	bottom := sat.row(y2)
+	var top []float64
+	if y1 > sat.y0 {
+		top = sat.row(y1 - 1)
+	}
+	i2, i1 := (x2-sat.xMin)*4, (x1-sat.xMin-1)*4
+	for c := 0; c < 4; c++ {
+		sums[c] = bottom[i2+c]
+		if top != nil {
+			sums[c] -= top[i2+c]
+		}
+		if i1 >= 0 {
+			sums[c] -= bottom[i1+c]
+			if top != nil {
+				sums[c] += top[i1+c]
+			}
+		}
+	}
+	return sums[0], sums[1], sums[2], sums[3]
+}
+
+// Write the box averages of the image slice from start to end position, read from the table,
+// to the output plane if linear. The alpha channel is averaged with the premultiplied colors,
+// where the zero border counts as opaque black.
+func (e *boxBlurEffect) filter(img *Image, sat *summedArea, start int, end int, linear bool) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	size := 2*e.radius + 1
+	for k := start; k < end; k++ {
+		y := k/n + yMin
+		x := k%n + xMin
+		x1, x2 := clip(x-e.radius, xMin, xMax-1), clip(x+e.radius, xMin, xMax-1)
+		y1, y2 := clip(y-e.radius, yMin, yMax-1), clip(y+e.radius, yMin, yMax-1)
+		rSum, gSum, bSum, aSum := sat.rect(x1, y1, x2, y2)
+		inside := (x2 - x1 + 1) * (y2 - y1 + 1)
+		area := float64(size * size)
+		if e.border == BorderRenormalize {
+			area = float64(inside)
+		} else {
+			aSum += float64(size*size-inside) * 0xffff
+		}
+		if linear {
+			writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride),
+				clampFloat(rSum/area), clampFloat(gSum/area), clampFloat(bSum/area), clampFloat(aSum/area))
+			continue
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride),
+			clamp(rSum/area), clamp(gSum/area), clamp(bSum/area), clamp(math.Round(aSum/area)))
+	}
+}
+
+// Return v limited to [lo, hi].
+func clip(v int, lo int, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
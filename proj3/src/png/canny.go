@@ -0,0 +1,307 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "canny", Params: []string{"sigma", "low", "high"}, New: newCannyEffect})
+}
+
+// The classes of the pixels after the double threshold.
+const (
+	cannyNone   = 0
+	cannyWeak   = 1
+	cannyStrong = 2
+)
+
+// The stages of the Canny edge detector.
+const (
+	cannySmoothRows    = iota // Horizontal gaussian pass of the intensity
+	cannySmoothColumns        // Vertical gaussian pass
+	cannyGradient             // Sobel gradient magnitude and direction
+	cannySuppress             // Non-maximum suppression and double threshold
+	cannyConnect              // Union of the neighbouring edge candidates
+	cannyMark                 // Mark the components holding a strong edge
+	cannyOutput               // Keep the candidates connected to a strong edge
+	cannyStages
+)
+
+// A cannyEffect detects edges with the Canny algorithm. The output is white on the edges
+// and black elsewhere, with the alpha channel of the input. Its thresholds are steps of the
+// perceived intensity, so an image in linear light is thresholded through its sRGB values.
+type cannyEffect struct {
+	sigma     float64
+	low, high float64   // The thresholds of the gradient magnitude, relative to the largest intensity step
+	weights   []float64 // The gaussian smoothing kernel
+}
+
+// The scratch planes of an image shared by the stages of the Canny edge detector,
+// indexed by the image slice position.
+type cannyState struct {
+	effect *cannyEffect
+	tmp    []float32 // The horizontally smoothed intensity
+	smooth []float32 // The smoothed intensity
+	mag    []float32 // The gradient magnitude
+	dir    []uint8   // The gradient direction, quantized to 0, 45, 90 and 135 degrees
+	class  []uint8   // The class of each pixel after the double threshold
+	parent []int32   // The union-find forest of the edge candidates
+	strong []uint32  // Set on the roots of the components holding a strong edge
+}
+
+// A cannyStage is one of the stages of the Canny edge detector.
+type cannyStage struct {
+	state *cannyState
+	phase int
+}
+
+// Create a Canny edge detector, where "sigma" is the standard deviation of the smoothing, 1.4 by default,
+// and "low" and "high" are the thresholds of the gradient magnitude as fractions of the largest intensity
+// step, 0.05 and 0.15 by default.
+func newCannyEffect(params map[string]any) (Effect, error) {
+	sigma, err := paramFloat(params, "sigma", 1.4, 0, maxGaussianSigma)
+	if err != nil {
+		return nil, err
+	}
+	low, err := paramFloat(params, "low", 0.05, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+	high, err := paramFloat(params, "high", 0.15, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+	if low > high {
+		return nil, errors.New("png: canny low threshold is above the high threshold")
+	}
+	weights := []float64{1}
+	if sigma > 0 {
+		weights = gaussianWeights(sigma)
+	}
+	return &cannyEffect{sigma: sigma, low: low, high: high, weights: weights}, nil
+}
+
+func (e *cannyEffect) Name() string { return "canny" }
+
+func (e *cannyEffect) Params() map[string]any {
+	return map[string]any{"sigma": e.sigma, "low": e.low, "high": e.high}
+}
+
+// The hysteresis connects edges across the whole image.
+func (e *cannyEffect) Radius() int { return math.MaxInt32 }
+
+// Apply the edge detector to the image slice. The edges may run through the whole image,
+// so every stage but the last one is computed on the whole image first, on every call.
+// Apply is meant to be called once for the whole image, the slices of an image are
+// applied through the stages, which compute each step once.
+func (e *cannyEffect) Apply(img *Image, start int, end int) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	numPixels := (yMax - yMin) * (xMax - xMin)
+	state := newCannyState(e, numPixels)
+	for phase := 0; phase < cannyOutput; phase++ {
+		state.run(phase, img, 0, numPixels)
+	}
+	state.run(cannyOutput, img, start, end)
+}
+
+// Every stage works on the slice of the image it is applied to. The edge candidates are connected
+// with a concurrent union-find, whose unions may cross slices, so that the hysteresis is independent
+// of the slicing of the image.
+func (e *cannyEffect) Stages(img *Image) []Effect {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	state := newCannyState(e, (yMax-yMin)*(xMax-xMin))
+	stages := make([]Effect, cannyStages)
+	for phase := range stages {
+		stages[phase] = &cannyStage{state, phase}
+	}
+	return stages
+}
+
+func (s *cannyStage) Name() string { return s.state.effect.Name() }
+
+func (s *cannyStage) Params() map[string]any {
+	return s.state.effect.Params()
+}
+
+func (s *cannyStage) Radius() int {
+	switch s.phase {
+	case cannySmoothRows, cannySmoothColumns:
+		return len(s.state.effect.weights) / 2
+	case cannyGradient, cannySuppress, cannyConnect:
+		return 1
+	}
+	return 0
+}
+
+func (s *cannyStage) Apply(img *Image, start int, end int) {
+	s.state.run(s.phase, img, start, end)
+	if s.phase != cannyOutput {
+		img.copyThrough(start, end)
+	}
+}
+
+// Return the empty scratch planes of an image with numPixels pixels.
+func newCannyState(e *cannyEffect, numPixels int) *cannyState {
+	return &cannyState{
+		effect: e,
+		tmp:    make([]float32, numPixels),
+		smooth: make([]float32, numPixels),
+		mag:    make([]float32, numPixels),
+		dir:    make([]uint8, numPixels),
+		class:  make([]uint8, numPixels),
+		parent: make([]int32, numPixels),
+		strong: make([]uint32, numPixels),
+	}
+}
+
+// Run a stage on the image slice from start to end position.
+func (s *cannyState) run(phase int, img *Image, start int, end int) {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	n, h := xMax-xMin, yMax-yMin
+	weights := s.effect.weights
+	radius := len(weights) / 2
+	for k := start; k < end; k++ {
+		x, y := k%n, k/n
+		switch phase {
+		case cannySmoothRows:
+			// The intensity is the mean of the rgb channels, as in the grayscale effect.
+			row := img.in.Pix[y*img.in.Stride:]
+			v := float64(0)
+			for i, w := range weights {
+				xx := clip(x+i-radius, 0, n-1)
+				r, g, b, _ := readPixel(row, xx*8)
+				v += float64(r+g+b) / 3 * w
+			}
+			s.tmp[k] = float32(v)
+		case cannySmoothColumns:
+			v := float64(0)
+			for i, w := range weights {
+				yy := clip(y+i-radius, 0, h-1)
+				v += float64(s.tmp[yy*n+x]) * w
+			}
+			s.smooth[k] = float32(v)
+		case cannyGradient:
+			var gx, gy float64
+			for i := 0; i < 9; i++ {
+				v := float64(s.smooth[clip(y+i/3-1, 0, h-1)*n+clip(x+i%3-1, 0, n-1)])
+				gx += v * sobelKernel.Weights[i]
+				gy += v * sobelKernel.Weights[(i%3)*3+i/3]
+			}
+			// Normalize by the gain of the Sobel operator, so that a step of the whole intensity range is 1.
+			s.mag[k] = float32(math.Hypot(gx, gy) / 4 / 65535)
+			s.dir[k] = quantizeDirection(gx, gy)
+		case cannySuppress:
+			s.class[k] = cannyNone
+			s.parent[k] = int32(k)
+			m := s.mag[k]
+			dx, dy := directionStep(s.dir[k])
+			if m < float32(s.effect.low) || m < s.magAt(x+dx, y+dy, n, h) || m < s.magAt(x-dx, y-dy, n, h) {
+				continue
+			}
+			s.class[k] = cannyWeak
+			if m >= float32(s.effect.high) {
+				s.class[k] = cannyStrong
+			}
+		case cannyConnect:
+			if s.class[k] == cannyNone {
+				continue
+			}
+			// Each pair of neighbours is connected once, from the later pixel.
+			for _, d := range [][2]int{{-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+				xx, yy := x+d[0], y+d[1]
+				if xx >= 0 && xx < n && yy >= 0 && s.class[yy*n+xx] != cannyNone {
+					s.union(int32(k), int32(yy*n+xx))
+				}
+			}
+		case cannyMark:
+			if s.class[k] == cannyStrong {
+				atomic.StoreUint32(&s.strong[s.find(int32(k))], 1)
+			}
+		case cannyOutput:
+			v := uint16(0)
+			if s.class[k] != cannyNone && atomic.LoadUint32(&s.strong[s.find(int32(k))]) == 1 {
+				v = 0xffff
+			}
+			_, _, _, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+			// The output is premultiplied by the alpha of the input.
+			v = uint16(uint32(v) * a / 0xffff)
+			writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), v, v, v, uint16(a))
+		}
+	}
+}
+
+// Return the gradient magnitude at (x, y), zero outside of the image.
+func (s *cannyState) magAt(x int, y int, n int, h int) float32 {
+	if x < 0 || x >= n || y < 0 || y >= h {
+		return 0
+	}
+	return s.mag[y*n+x]
+}
+
+// Quantize the gradient direction to 0 (horizontal), 1 (45 degrees), 2 (vertical) or 3 (135 degrees),
+// where y grows downwards.
+func quantizeDirection(gx float64, gy float64) uint8 {
+	angle := math.Atan2(gy, gx) * 180 / math.Pi
+	if angle < 0 {
+		angle += 180
+	}
+	switch {
+	case angle < 22.5 || angle >= 157.5:
+		return 0
+	case angle < 67.5:
+		return 1
+	case angle < 112.5:
+		return 2
+	}
+	return 3
+}
+
+// Return the step to the next pixel along a quantized gradient direction.
+func directionStep(dir uint8) (int, int) {
+	switch dir {
+	case 0:
+		return 1, 0
+	case 1:
+		return 1, 1
+	case 2:
+		return 0, 1
+	}
+	return -1, 1
+}
+
+// Return the root of the component of i, halving the path on the way.
+// It is safe for concurrent use with union.
+func (s *cannyState) find(i int32) int32 {
+	for {
+		p := atomic.LoadInt32(&s.parent[i])
+		if p == i {
+			return i
+		}
+		gp := atomic.LoadInt32(&s.parent[p])
+		if gp != p {
+			atomic.CompareAndSwapInt32(&s.parent[i], p, gp)
+		}
+		i = p
+	}
+}
+
+// Merge the components of a and b, linking the root with the larger index to the other one.
+// It is safe for concurrent use, a failed link is retried from the new roots.
+func (s *cannyState) union(a int32, b int32) {
+	for {
+		a, b = s.find(a), s.find(b)
+		if a == b {
+			return
+		}
+		if a < b {
+			a, b = b, a
+		}
+		if atomic.CompareAndSwapInt32(&s.parent[a], a, b) {
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"image"
+	"sync"
+)
+
+// Copy the decoded image src into dst, which has the same bounds, as 16-bit premultiplied rgba.
+// The rows are split in bands converted by the given number of goroutines.
+func convert(dst *image.RGBA64, src image.Image, threads int) {
+	bounds := src.Bounds()
+	if threads <= 1 {
+		convertRows(dst, src, bounds.Min.Y, bounds.Max.Y, nil)
+		return
+	}
+	var wg sync.WaitGroup
+	rowsPerThread := (bounds.Dy() + threads - 1) / threads
+	for i := 0; i < threads; i++ {
+		yStart := bounds.Min.Y + i*rowsPerThread
+		yEnd := yStart + rowsPerThread
+		if yEnd > bounds.Max.Y {
+			yEnd = bounds.Max.Y
+		}
+		if yStart >= yEnd {
+			break
+		}
+		wg.Add(1)
+		go convertRows(dst, src, yStart, yEnd, &wg)
+	}
+	wg.Wait()
+}
+
+// Convert the rows from yStart to yEnd of src into dst.
+// The common decoded image types are read directly from their Pix buffers,
+// with the same results as their RGBA methods.
+func convertRows(dst *image.RGBA64, src image.Image, yStart int, yEnd int, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+	bounds := src.Bounds()
+	width := bounds.Dx()
+	for y := yStart; y < yEnd; y++ {
+		dstRow := dst.Pix[(y-bounds.Min.Y)*dst.Stride:]
+		switch m := src.(type) {
+		case *image.NRGBA:
+			srcRow := m.Pix[m.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < width; x++ {
+				s := srcRow[x*4 : x*4+4 : x*4+4]
+				a := uint32(s[3]) * 0x101
+				r := uint32(s[0]) * 0x101 * uint32(s[3]) / 0xff
+				g := uint32(s[1]) * 0x101 * uint32(s[3]) / 0xff
+				b := uint32(s[2]) * 0x101 * uint32(s[3]) / 0xff
+				writePixel(dstRow, x*8, uint16(r), uint16(g), uint16(b), uint16(a))
+			}
+		case *image.RGBA:
+			srcRow := m.Pix[m.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < width; x++ {
+				s := srcRow[x*4 : x*4+4 : x*4+4]
+				writePixel(dstRow, x*8, uint16(s[0])*0x101, uint16(s[1])*0x101, uint16(s[2])*0x101, uint16(s[3])*0x101)
+			}
+		case *image.Gray:
+			srcRow := m.Pix[m.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < width; x++ {
+				v := uint16(srcRow[x]) * 0x101
+				writePixel(dstRow, x*8, v, v, v, 0xffff)
+			}
+		case *image.RGBA64:
+			srcRow := m.Pix[m.PixOffset(bounds.Min.X, y):]
+			copy(dstRow[:width*8], srcRow)
+		default:
+			for x := 0; x < width; x++ {
+				r, g, b, a := src.At(bounds.Min.X+x, y).RGBA()
+				writePixel(dstRow, x*8, uint16(r), uint16(g), uint16(b), uint16(a))
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/adler32"
+	"sync"
+)
+
+const (
+	deflateBlockLen = 128 << 10 // The minimum length of the data compressed by one goroutine
+	deflateDictLen  = 32 << 10  // The deflate window, primed with the end of the previous block
+	adlerBase       = 65521
+)
+
+// A deflated block of the zlib stream.
+type deflateBlock struct {
+	data       []byte // The uncompressed data
+	compressed bytes.Buffer
+	adler      uint32
+	err        error
+}
+
+// Write the filtered scanlines as a zlib stream in IDAT chunks, where the scanlines are filtered
+// and compressed by e.threads goroutines. The data is split in blocks that are deflated independently
+// and ended with a sync flush, so they can be concatenated into a single deflate stream.
+func (e *encoder) writeIDATsParallel() {
+	rowLen := e.rowLen() + 1
+	filtered := make([]byte, e.height*rowLen)
+
+	// Filter bands of rows in parallel.
+	var wg sync.WaitGroup
+	rowsPerThread := (e.height + e.threads - 1) / e.threads
+	for i := 0; i < e.threads; i++ {
+		rowStart, rowEnd := i*rowsPerThread, (i+1)*rowsPerThread
+		if rowEnd > e.height {
+			rowEnd = e.height
+		}
+		if rowStart >= rowEnd {
+			break
+		}
+		wg.Add(1)
+		go e.filterRows(filtered, rowStart, rowEnd, &wg)
+	}
+	wg.Wait()
+
+	// Split the filtered data in blocks of at least deflateBlockLen bytes.
+	blockLen := (len(filtered) + e.threads - 1) / e.threads
+	if blockLen < deflateBlockLen {
+		blockLen = deflateBlockLen
+	}
+	var blocks []*deflateBlock
+	for start := 0; start < len(filtered); start += blockLen {
+		end := start + blockLen
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		blocks = append(blocks, &deflateBlock{data: filtered[start:end]})
+	}
+	// An empty image still needs a final deflate block.
+	if len(blocks) == 0 {
+		blocks = append(blocks, &deflateBlock{})
+	}
+
+	// Deflate the blocks in parallel, each primed with the data preceding it.
+	for i, block := range blocks {
+		dictStart := i*blockLen - deflateDictLen
+		if dictStart < 0 {
+			dictStart = 0
+		}
+		wg.Add(1)
+		go block.deflate(filtered[dictStart:i*blockLen], e.level, i == len(blocks)-1, &wg)
+	}
+	wg.Wait()
+
+	// Stitch the zlib header, the deflated blocks and the checksum of the whole data.
+	buf := newIDATBuffer(e)
+	buf.Write(zlibHeader(e.level))
+	adler := adler32.Checksum(nil)
+	for _, block := range blocks {
+		if block.err != nil {
+			e.err = block.err
+			return
+		}
+		buf.Write(block.compressed.Bytes())
+		adler = adler32Combine(adler, block.adler, len(block.data))
+	}
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], adler)
+	buf.Write(footer[:])
+	if err := buf.Flush(); err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// Filter the scanlines from rowStart to rowEnd into their position in filtered.
+func (e *encoder) filterRows(filtered []byte, rowStart int, rowEnd int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	rowLen := e.rowLen()
+	prev := make([]byte, rowLen)
+	cur := make([]byte, rowLen)
+	scratch := make([][]byte, numFilters)
+	for f := range scratch {
+		scratch[f] = make([]byte, rowLen+1)
+	}
+	if rowStart > 0 {
+		e.rawRow(prev, rowStart-1)
+	}
+	for y := rowStart; y < rowEnd; y++ {
+		e.rawRow(cur, y)
+		out := filterRow(scratch, cur, prev, e.bytesPerPixel(), e.level == flate.NoCompression)
+		copy(filtered[y*(rowLen+1):], out)
+		prev, cur = cur, prev
+	}
+}
+
+// Deflate the block, using dict as the preceding data of the stream.
+// The last block ends the deflate stream, the others end with a sync flush.
+func (block *deflateBlock) deflate(dict []byte, level int, last bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	block.adler = adler32.Checksum(block.data)
+	fw, err := flate.NewWriterDict(&block.compressed, level, dict)
+	if err != nil {
+		block.err = err
+		return
+	}
+	if _, err = fw.Write(block.data); err != nil {
+		block.err = err
+		return
+	}
+	if last {
+		block.err = fw.Close()
+	} else {
+		block.err = fw.Flush()
+	}
+}
+
+// Return the two bytes zlib header for the compression level, as written by compress/zlib.
+func zlibHeader(level int) []byte {
+	header := []byte{0x78, 0}
+	switch level {
+	case -2, 0, 1:
+		header[1] = 0 << 6
+	case 2, 3, 4, 5:
+		header[1] = 1 << 6
+	case 6, -1:
+		header[1] = 2 << 6
+	case 7, 8, 9:
+		header[1] = 3 << 6
+	}
+	header[1] += uint8(31 - (uint16(header[0])<<8+uint16(header[1]))%31)
+	return header
+}
+
+// Return the Adler-32 checksum of the concatenation of two byte sequences,
+// given their checksums and the length of the second one.
+func adler32Combine(adler1 uint32, adler2 uint32, len2 int) uint32 {
+	rem := uint32(len2 % adlerBase)
+	sum1 := adler1 & 0xffff
+	sum2 := (rem * sum1) % adlerBase
+	sum1 += (adler2 & 0xffff) + adlerBase - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + adlerBase - rem
+	if sum1 >= adlerBase {
+		sum1 -= adlerBase
+	}
+	if sum1 >= adlerBase {
+		sum1 -= adlerBase
+	}
+	if sum2 >= adlerBase<<1 {
+		sum2 -= adlerBase << 1
+	}
+	if sum2 >= adlerBase {
+		sum2 -= adlerBase
+	}
+	return sum1 | sum2<<16
+}
@@ -0,0 +1,68 @@
+package png
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	for size := 1; size < 40; size++ {
+		values := make([]float64, size)
+		for i := range values {
+			values[i] = float64(rand.Intn(10))
+		}
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		if m := median(values); m != sorted[size/2] {
+			t.Errorf("FAILED: median of %v is %v, expected %v", sorted, m, sorted[size/2])
+		}
+	}
+}
+
+func TestMedianRemovesNoise(t *testing.T) {
+	img := newStepImage(9, 9, func(x int, y int) uint16 {
+		if (x+y)%7 == 0 {
+			return 0xffff
+		}
+		return 0x3000
+	})
+	effect, _ := NewEffect("median", map[string]any{"border": "clamp"})
+	effect.Apply(img, 0, 81)
+	for i := 0; i < len(img.out.Pix); i += 8 {
+		if r, g, b, _ := readPixel(img.out.Pix, i); r != 0x3000 || g != 0x3000 || b != 0x3000 {
+			t.Fatalf("FAILED: median pixel %v is %x,%x,%x", i/8, r, g, b)
+		}
+	}
+}
+
+func TestBilateralPreservesEdges(t *testing.T) {
+	img := newStepImage(12, 6, func(x int, y int) uint16 {
+		if x < 6 {
+			return 0x1000
+		}
+		return 0xf000
+	})
+	effect, err := NewEffect("bilateral", map[string]any{"sigmaSpatial": 2.0, "sigmaRange": 0.05, "border": "mirror"})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	effect.Apply(img, 0, 72)
+	for y := 0; y < 6; y++ {
+		left, _, _, _ := img.out.At(5, y).RGBA()
+		right, _, _, _ := img.out.At(6, y).RGBA()
+		if absDiff(left, 0x1000) > 1 || absDiff(right, 0xf000) > 1 {
+			t.Errorf("FAILED: bilateral blurred the edge at row %v to %x and %x", y, left, right)
+		}
+	}
+
+	// The weights are normalized near the borders.
+	img = newStepImage(7, 5, func(x int, y int) uint16 { return 0x8000 })
+	effect, _ = NewEffect("bilateral", map[string]any{"border": "renormalize"})
+	effect.Apply(img, 0, 35)
+	for i := 0; i < len(img.out.Pix); i += 8 {
+		if r, _, _, _ := readPixel(img.out.Pix, i); absDiff(r, 0x8000) > 1 {
+			t.Fatalf("FAILED: bilateral changed flat pixel %v to %x", i/8, r)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// newStepImage returns a w x h gray image with the intensity given by f.
+func newStepImage(w int, h int, f func(x int, y int) uint16) *Image {
+	bounds := image.Rect(0, 0, w, h)
+	img := &Image{in: image.NewRGBA64(bounds), out: image.NewRGBA64(bounds), Bounds: bounds}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := f(x, y)
+			writePixel(img.in.Pix, img.in.PixOffset(x, y), v, v, v, 0xffff)
+		}
+	}
+	return img
+}
+
+func TestGradientEffects(t *testing.T) {
+	step := func(x int, y int) uint16 {
+		if x < 4 {
+			return 0
+		}
+		return 0x1000
+	}
+	for name, gain := range map[string]uint32{"sobel": 4, "prewitt": 3} {
+		effect, err := NewEffect(name, map[string]any{"border": "clamp"})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		img := newStepImage(8, 5, step)
+		effect.Apply(img, 0, 40)
+		for y := 0; y < 5; y++ {
+			if r, _, _, _ := img.out.At(3, y).RGBA(); r != gain*0x1000 {
+				t.Errorf("FAILED: %v magnitude at the step is %v, expected %v", name, r, gain*0x1000)
+			}
+			if r, _, _, _ := img.out.At(0, y).RGBA(); r != 0 {
+				t.Errorf("FAILED: %v magnitude of a flat area is %v", name, r)
+			}
+		}
+	}
+}
+
+func TestCannyHysteresis(t *testing.T) {
+	// A vertical step at x = 10, strong in the top rows and weak below, and an isolated weak step at x = 20.
+	intensity := func(x int, y int) uint16 {
+		switch {
+		case x < 10:
+			return 0
+		case x < 20 && y < 5:
+			return 0xffff
+		case x < 20 || y < 12:
+			return 0x2000
+		}
+		return 0x4000
+	}
+	effect, err := NewEffect("canny", map[string]any{"sigma": 0.0})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	isEdge := func(img *Image, x int, y int) bool {
+		r, _, _, _ := img.out.At(x, y).RGBA()
+		return r == 0xffff
+	}
+
+	expected := newStepImage(30, 20, intensity)
+	effect.Apply(expected, 0, 600)
+	for y := 0; y < 20; y++ {
+		// The corner with the horizontal step between the strong and weak parts may bend the edge.
+		if y >= 4 && y <= 6 {
+			continue
+		}
+		if !isEdge(expected, 9, y) && !isEdge(expected, 10, y) {
+			t.Errorf("FAILED: the step connected to a strong edge is missing at row %v", y)
+		}
+	}
+	for y := 13; y < 19; y++ {
+		if isEdge(expected, 19, y) || isEdge(expected, 20, y) {
+			t.Errorf("FAILED: the isolated weak step is kept at row %v", y)
+		}
+	}
+
+	// Slices of one row, less than a row and the whole image.
+	for _, chunk := range []int{30, 7, 600} {
+		img := newStepImage(30, 20, intensity)
+		applyStages(img, effect, chunk)
+		if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+			t.Errorf("FAILED: canny stages with chunks of %v pixels differ from the direct detector", chunk)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"fmt"
+	"image"
+)
+
+// An Effect is an image filter that reads the input buffer of an image and writes its output buffer.
+// Applying an effect to disjoint pixel ranges of the same image concurrently is safe.
+type Effect interface {
+	Name() string                         // The registered name of the effect
+	Params() map[string]any               // The parameters of the effect, as accepted by NewEffect
+	Radius() int                          // The number of neighbours read on each side of a pixel
+	Apply(img *Image, start int, end int) // Apply the effect from start to end position, concatenating row-wise
+}
+
+// A StagedEffect is applied as several stages, each reading the output of the previous one.
+// Like separate effects, every stage is applied to the whole image and followed by a Swap,
+// so a stage starts once the previous one is complete. The stages of an image may share
+// scratch buffers, a stage that only fills them copies its pixels through to the output.
+type StagedEffect interface {
+	Effect
+	Stages(img *Image) []Effect // The stages applied to the image in order, each one is applied like an effect
+}
+
+// A GeometricEffect changes the bounds of the image, e.g. a resize or a rotation.
+// Its output buffer has the bounds it returns for the bounds of the input buffer,
+// starting at (0, 0), and it is applied to slices of the output pixels.
+type GeometricEffect interface {
+	Effect
+	OutputBounds(in image.Rectangle) image.Rectangle // The bounds of the output for an input with the given bounds
+}
+
+// A ScratchEffect needs scratch planes with the bounds of the image besides the input and output
+// buffers, e.g. to keep the original pixels while they are blurred. The schedulers allocate the planes
+// with Image.AllocatePlanes before applying the stages, and release them afterwards.
+type ScratchEffect interface {
+	Effect
+	ScratchPlanes() int // The number of scratch planes shared by the stages
+}
+
+// A LinearEffect can also be applied to an image loaded in linear light, reading and writing
+// its float planes instead of its 16-bit buffers. The stages of a staged LinearEffect are LinearEffects.
+// The other effects, whose parameters are perceptual levels, e.g. the thresholds and the histogram
+// equalizations, are applied to the sRGB values of an image in linear light, as their documentation says.
+type LinearEffect interface {
+	Effect
+	ApplyLinear(img *Image, start int, end int) // Apply the effect to the float planes from start to end position
+}
+
+// A CheckedEffect cannot apply to every image, e.g. a crop to a rectangle outside of the image.
+// The schedulers check it with CheckEffect on the image it is about to be applied to.
+type CheckedEffect interface {
+	Effect
+	Check(img *Image) error // Report why the effect cannot be applied to the image, nil if it can
+}
+
+// CheckEffect reports whether the effect can be applied to the image in its current bounds.
+func CheckEffect(effect Effect, img *Image) error {
+	if checked, ok := effect.(CheckedEffect); ok {
+		return checked.Check(img)
+	}
+	return nil
+}
+
+// Stages returns the stages of an effect applied to the image, which is the effect itself
+// unless it is a StagedEffect. In linear light, the stages of a LinearEffect apply to the float planes,
+// and the stages of the other effects are surrounded by the conversions to sRGB and back.
+func Stages(effect Effect, img *Image) []Effect {
+	stages := []Effect{effect}
+	if staged, ok := effect.(StagedEffect); ok {
+		stages = staged.Stages(img)
+	}
+	if img == nil || !img.linear {
+		return stages
+	}
+	if img.appliesLinear(effect) {
+		for i, stage := range stages {
+			stages[i] = &linearStage{stage.(LinearEffect)}
+		}
+		return stages
+	}
+	stages = append([]Effect{&transferStage{effect, true}}, stages...)
+	return append(stages, &transferStage{effect, false})
+}
+
+// An EffectSpec describes an effect that can be created by name.
+type EffectSpec struct {
+	Name    string                                      // The name of the effect, e.g. "blur"
+	Aliases []string                                    // The other names of the effect, e.g. "B"
+	Params  []string                                    // The names of the parameters accepted by the effect
+	New     func(params map[string]any) (Effect, error) // Create the effect, the parameters are all accepted ones
+}
+
+// The registered effects by name and alias.
+var effectSpecs = make(map[string]*EffectSpec)
+
+// RegisterEffect makes an effect available to NewEffect under its name and aliases.
+// It panics if one of the names is already registered.
+func RegisterEffect(spec EffectSpec) {
+	registered := &spec
+	for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+		if _, ok := effectSpecs[name]; ok {
+			panic(fmt.Sprintf("png: effect %q registered twice", name))
+		}
+		effectSpecs[name] = registered
+	}
+}
+
+// LookupEffect returns the effect registered with the given name or alias.
+func LookupEffect(name string) (*EffectSpec, bool) {
+	spec, ok := effectSpecs[name]
+	return spec, ok
+}
+
+// Takes reports whether the effect accepts the given parameter.
+func (spec *EffectSpec) Takes(param string) bool {
+	for _, p := range spec.Params {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEffect returns the effect registered with the given name or alias, created with the parameters.
+func NewEffect(name string, params map[string]any) (Effect, error) {
+	spec, ok := LookupEffect(name)
+	if !ok {
+		return nil, fmt.Errorf("png: unknown effect %q", name)
+	}
+	for param := range params {
+		if !spec.Takes(param) {
+			return nil, fmt.Errorf("png: effect %q has no parameter %q", spec.Name, param)
+		}
+	}
+	return spec.New(params)
+}
+
+// ValidateEffect checks the parameters of an effect again, by creating it from its name and parameters.
+func ValidateEffect(effect Effect) error {
+	_, err := NewEffect(effect.Name(), effect.Params())
+	return err
+}
+
+// Return the border policy given by the parameter key, BorderZero if it is absent.
+func paramBorder(params map[string]any, key string) (Border, error) {
+	v, ok := params[key]
+	if !ok {
+		return BorderZero, nil
+	}
+	name, ok := v.(string)
+	if !ok {
+		return BorderZero, fmt.Errorf("png: parameter %q must be a string, got %v", key, v)
+	}
+	return ParseBorder(name)
+}
+
+// Return the number given by the parameter key within [lo, hi], def if it is absent.
+// Numbers read from JSON are float64, integers are accepted too.
+func paramFloat(params map[string]any, key string, def float64, lo float64, hi float64) (float64, error) {
+	v, ok := params[key]
+	if !ok {
+		return def, nil
+	}
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case int:
+		f = float64(n)
+	default:
+		return 0, fmt.Errorf("png: parameter %q must be a number, got %v", key, v)
+	}
+	if !(f >= lo && f <= hi) {
+		return 0, fmt.Errorf("png: parameter %q must be from %v to %v, got %v", key, lo, hi, v)
+	}
+	return f, nil
+}
+
+// Return the list of numbers given by the parameter key, whose length must be one of sizes,
+// nil if it is absent. Lists read from JSON hold float64 numbers.
+func paramFloats(params map[string]any, key string, sizes ...int) ([]float64, error) {
+	v, ok := params[key]
+	if !ok {
+		return nil, nil
+	}
+	var list []float64
+	switch l := v.(type) {
+	case []float64:
+		list = append(list, l...)
+	case []any:
+		for _, item := range l {
+			f, ok := item.(float64)
+			if !ok {
+				return nil, fmt.Errorf("png: parameter %q must be a list of numbers, got %v", key, v)
+			}
+			list = append(list, f)
+		}
+	default:
+		return nil, fmt.Errorf("png: parameter %q must be a list of numbers, got %v", key, v)
+	}
+	for _, size := range sizes {
+		if len(list) == size {
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("png: parameter %q must have %v numbers, got %v", key, sizes, len(list))
+}
+
+// Return the integer given by the parameter key within [lo, hi], def if it is absent.
+func paramInt(params map[string]any, key string, def int, lo int, hi int) (int, error) {
+	f, err := paramFloat(params, key, float64(def), float64(lo), float64(hi))
+	if err != nil {
+		return 0, err
+	}
+	if f != float64(int(f)) {
+		return 0, fmt.Errorf("png: parameter %q must be an integer, got %v", key, params[key])
+	}
+	return int(f), nil
+}
@@ -0,0 +1,157 @@
+package png
+
+import (
+	"bytes"
+	"hash/adler32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// Encode the output buffer of img and decode it with the standard library.
+func roundTrip(t *testing.T, img *Image, options SaveOptions) image.Image {
+	var buf bytes.Buffer
+	if err := img.encodePNG(&buf, options); err != nil {
+		t.Fatalf("FAILED: encode error %v", err)
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("FAILED: decode error %v", err)
+	}
+	return decoded
+}
+
+func TestEncodeColorTypes(t *testing.T) {
+	img := newTestImage(13, 9)
+	img.Swap()
+	// Make one pixel translucent.
+	img.out.Set(3, 4, color.RGBA64{0x4000, 0x2000, 0x1000, 0x8000})
+
+	cases := []struct {
+		options SaveOptions
+		model   color.Model
+	}{
+		{SaveOptions{}, color.NRGBA64Model},
+		{SaveOptions{BitDepth: 8}, color.NRGBAModel},
+		{SaveOptions{CompressionLevel: NoCompression}, color.NRGBA64Model},
+		{SaveOptions{CompressionLevel: 9, BitDepth: 8}, color.NRGBAModel},
+	}
+	for _, c := range cases {
+		decoded := roundTrip(t, img, c.options)
+		for y := 0; y < 9; y++ {
+			for x := 0; x < 13; x++ {
+				expected := c.model.Convert(img.out.At(x, y))
+				if c.model == color.NRGBAModel {
+					expected = roundedNRGBA(img.out.At(x, y))
+				}
+				if got := c.model.Convert(decoded.At(x, y)); got != expected {
+					t.Fatalf("FAILED: %+v pixel (%v,%v) is %v, expected %v", c.options, x, y, got, expected)
+				}
+			}
+		}
+	}
+}
+
+// Return the 8-bit non-premultiplied color c, rounded to the nearest like the encoder.
+func roundedNRGBA(c color.Color) color.NRGBA {
+	r, g, b, a := c.RGBA()
+	r, g, b = unpremultiply(r, g, b, a)
+	return color.NRGBA{to8Bit(r), to8Bit(g), to8Bit(b), to8Bit(a)}
+}
+
+func TestEncodeKeepsSourceDepth(t *testing.T) {
+	img := newTestImage(4, 4)
+	img.Swap()
+	img.depth = 8
+	if _, ok := roundTrip(t, img, SaveOptions{}).(*image.RGBA); !ok {
+		t.Errorf("FAILED: opaque 8-bit image should be saved as 8-bit RGB")
+	}
+	if _, ok := roundTrip(t, img, SaveOptions{KeepAlpha: true}).(*image.NRGBA); !ok {
+		t.Errorf("FAILED: alpha should be kept when requested")
+	}
+	img.depth = 16
+	if _, ok := roundTrip(t, img, SaveOptions{}).(*image.RGBA64); !ok {
+		t.Errorf("FAILED: opaque 16-bit image should be saved as 16-bit RGB")
+	}
+}
+
+func TestEncodeGrayscaleAndPalette(t *testing.T) {
+	img := newTestImage(6, 5)
+	img.Swap()
+	if err := img.encodePNG(&bytes.Buffer{}, SaveOptions{Grayscale: true}); err != ErrNotGray {
+		t.Errorf("FAILED: colored image should not be saved as grayscale, got %v", err)
+	}
+	img.Swap()
+	img.Grayscale(0, 30)
+	img.depth = 8
+	if gray, ok := roundTrip(t, img, SaveOptions{Grayscale: true}).(*image.Gray); !ok {
+		t.Errorf("FAILED: gray image should be saved as 8-bit grayscale")
+	} else if r, _, _, _ := img.out.At(2, 3).RGBA(); gray.GrayAt(2, 3).Y != to8Bit(r) {
+		t.Errorf("FAILED: gray value %v, expected %v", gray.GrayAt(2, 3).Y, to8Bit(r))
+	}
+	paletted, ok := roundTrip(t, img, SaveOptions{Palette: true}).(*image.Paletted)
+	if !ok {
+		t.Fatalf("FAILED: image with few colors should be saved as paletted")
+	}
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 6; x++ {
+			if got, expected := color.NRGBAModel.Convert(paletted.At(x, y)), roundedNRGBA(img.out.At(x, y)); got != expected {
+				t.Fatalf("FAILED: paletted pixel (%v,%v) is %v, expected %v", x, y, got, expected)
+			}
+		}
+	}
+}
+
+func TestEncodeParallel(t *testing.T) {
+	// Large enough for several deflate blocks.
+	img := newTestImage(300, 250)
+	img.Swap()
+	img.out.Set(7, 9, color.RGBA64{0x4000, 0x2000, 0x1000, 0x8000})
+	for _, options := range []SaveOptions{{Threads: 4}, {Threads: 3, BitDepth: 8, CompressionLevel: 9}, {Threads: 2, CompressionLevel: NoCompression}} {
+		serial := options
+		serial.Threads = 1
+		expected := roundTrip(t, img, serial)
+		decoded := roundTrip(t, img, options)
+		for y := 0; y < 250; y++ {
+			for x := 0; x < 300; x++ {
+				if decoded.At(x, y) != expected.At(x, y) {
+					t.Fatalf("FAILED: %+v pixel (%v,%v) is %v, expected %v", options, x, y, decoded.At(x, y), expected.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeEmptyImage(t *testing.T) {
+	for _, size := range [][2]int{{0, 4}, {4, 0}} {
+		img := newTestImage(size[0], size[1])
+		if err := img.encodePNG(io.Discard, SaveOptions{}); err == nil {
+			t.Errorf("FAILED: %vx%v image should not be saved", size[0], size[1])
+		}
+	}
+}
+
+func TestEncodeChannelAboveAlpha(t *testing.T) {
+	// A color above its alpha is not premultiplied, and saturates when saved.
+	img := newTestImage(3, 3)
+	img.Swap()
+	writePixel(img.out.Pix, img.out.PixOffset(1, 1), 40000, 40000, 40000, 0x8000)
+	for _, depth := range []int{8, 16} {
+		saved := roundTrip(t, img, SaveOptions{BitDepth: depth}).At(1, 1)
+		if c := color.NRGBA64Model.Convert(saved).(color.NRGBA64); c.R != 0xffff {
+			t.Errorf("FAILED: color above alpha is saved as %v with bit depth %v", c, depth)
+		}
+	}
+}
+
+func TestAdler32Combine(t *testing.T) {
+	data := bytes.Repeat([]byte("parallel png encoding "), 5000)
+	for _, split := range []int{0, 1, 65521, 70000, len(data)} {
+		combined := adler32Combine(adler32.Checksum(data[:split]), adler32.Checksum(data[split:]), len(data)-split)
+		if combined != adler32.Checksum(data) {
+			t.Errorf("FAILED: combined checksum at %v is %x, expected %x", split, combined, adler32.Checksum(data))
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"math"
+	"sync"
+)
+
+// The largest number of CLAHE tiles along each axis.
+const maxCLAHETiles = 64
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "equalize", New: newEqualizeEffect})
+	RegisterEffect(EffectSpec{Name: "clahe", Params: []string{"tiles", "clip"}, New: newCLAHEEffect})
+}
+
+// The stages of the histogram equalization.
+const (
+	equalizeHistogram = iota // Reduction of the tile histograms of the slices
+	equalizeRemap            // Interpolated remapping of every pixel
+	equalizeStages
+)
+
+// An equalizeEffect spreads the intensities of the image over the whole range.
+// The image is split in a grid of tiles, each one equalized with the cumulative histogram
+// of its intensities, clipped to limit the contrast gain, and the mappings of the four nearest
+// tiles are interpolated at each pixel. A global equalization is a single tile without clipping.
+// The mapping is applied to each rgb channel, so gray pixels stay gray.
+// The histograms count sRGB levels, which are perceptually even, also for an image in linear light.
+type equalizeEffect struct {
+	name  string
+	tiles int     // The number of tiles along each axis
+	clip  float64 // The limit of a histogram bin as a multiple of the mean bin, 0 for no limit
+}
+
+// The tile histograms of an image shared by the stages of the equalization.
+type equalizeState struct {
+	effect         *equalizeEffect
+	width, height  int
+	tilesX, tilesY int
+	lock           sync.Mutex
+	hist           [][]uint64 // The intensity histogram of each tile, in row-major order
+	once           sync.Once
+	luts           [][]uint16 // The mapping of the intensity levels of each tile
+}
+
+// An equalizeStage is one of the stages of the histogram equalization.
+type equalizeStage struct {
+	state *equalizeState
+	phase int
+}
+
+// Create a global histogram equalization, which takes no parameters.
+func newEqualizeEffect(params map[string]any) (Effect, error) {
+	return &equalizeEffect{name: "equalize", tiles: 1}, nil
+}
+
+// Create a contrast limited adaptive histogram equalization, where "tiles" is the number of tiles
+// along each axis, 8 by default, and "clip" is the limit of a histogram bin as a multiple of
+// the mean bin, 2 by default.
+func newCLAHEEffect(params map[string]any) (Effect, error) {
+	tiles, err := paramInt(params, "tiles", 8, 1, maxCLAHETiles)
+	if err != nil {
+		return nil, err
+	}
+	clip, err := paramFloat(params, "clip", 2, 1, histLevels)
+	if err != nil {
+		return nil, err
+	}
+	return &equalizeEffect{name: "clahe", tiles: tiles, clip: clip}, nil
+}
+
+func (e *equalizeEffect) Name() string { return e.name }
+
+func (e *equalizeEffect) Params() map[string]any {
+	if e.name == "equalize" {
+		return map[string]any{}
+	}
+	return map[string]any{"tiles": e.tiles, "clip": e.clip}
+}
+
+// The mapping depends on whole tiles.
+func (e *equalizeEffect) Radius() int { return math.MaxInt32 }
+
+// Apply the equalization to the image slice, from the histograms of the whole image.
+func (e *equalizeEffect) Apply(img *Image, start int, end int) {
+	state := newEqualizeState(e, img)
+	state.run(equalizeHistogram, img, 0, state.width*state.height)
+	state.run(equalizeRemap, img, start, end)
+}
+
+// The tile histograms are reduced from the histograms of the slices, then every slice is remapped
+// with the mappings of the tiles, which are computed once by the first slice reaching the second stage.
+func (e *equalizeEffect) Stages(img *Image) []Effect {
+	state := newEqualizeState(e, img)
+	return []Effect{&equalizeStage{state, equalizeHistogram}, &equalizeStage{state, equalizeRemap}}
+}
+
+func (s *equalizeStage) Name() string { return s.state.effect.Name() }
+
+func (s *equalizeStage) Params() map[string]any {
+	return s.state.effect.Params()
+}
+
+func (s *equalizeStage) Radius() int { return 0 }
+
+func (s *equalizeStage) Apply(img *Image, start int, end int) {
+	s.state.run(s.phase, img, start, end)
+	if s.phase == equalizeHistogram {
+		img.copyThrough(start, end)
+	}
+}
+
+// Return the empty histograms of the tiles of the image. An image smaller than the grid
+// has a single column or row of tiles per pixel.
+func newEqualizeState(e *equalizeEffect, img *Image) *equalizeState {
+	yMin, yMax, xMin, xMax := img.GetBounds()
+	s := &equalizeState{effect: e, width: xMax - xMin, height: yMax - yMin, tilesX: e.tiles, tilesY: e.tiles}
+	if s.tilesX > s.width && s.width > 0 {
+		s.tilesX = s.width
+	}
+	if s.tilesY > s.height && s.height > 0 {
+		s.tilesY = s.height
+	}
+	s.hist = make([][]uint64, s.tilesX*s.tilesY)
+	for i := range s.hist {
+		s.hist[i] = make([]uint64, histLevels)
+	}
+	return s
+}
+
+// Run a stage on the image slice from start to end position.
+func (s *equalizeState) run(phase int, img *Image, start int, end int) {
+	n := s.width
+	switch phase {
+	case equalizeHistogram:
+		// Count the slice in local histograms of the tiles it covers, merged once into the shared ones.
+		local := make([][]uint64, len(s.hist))
+		for k := start; k < end; k++ {
+			r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+			// Transparent pixels have no intensity.
+			if a == 0 {
+				continue
+			}
+			r, g, b = unpremultiply(r, g, b, a)
+			tile := (k/n*s.tilesY/s.height)*s.tilesX + k%n*s.tilesX/n
+			if local[tile] == nil {
+				local[tile] = make([]uint64, histLevels)
+			}
+			local[tile][(r+g+b)/3>>8]++
+		}
+		s.lock.Lock()
+		for tile, hist := range local {
+			for i, c := range hist {
+				s.hist[tile][i] += c
+			}
+		}
+		s.lock.Unlock()
+	case equalizeRemap:
+		s.once.Do(s.buildMappings)
+		for k := start; k < end; k++ {
+			x, y := k%n, k/n
+			r, g, b, a := readPixel(img.in.Pix, pixOffset(k, n, img.in.Stride))
+			r, g, b = unpremultiply(r, g, b, a)
+			// Interpolate between the mappings of the four tiles whose centers surround the pixel.
+			tx0, tx1, wx := tileWeights(x, n, s.tilesX)
+			ty0, ty1, wy := tileWeights(y, s.height, s.tilesY)
+			rgb := [3]uint32{r, g, b}
+			for c, v := range rgb {
+				level := v >> 8
+				top := (1-wx)*float64(s.luts[ty0*s.tilesX+tx0][level]) + wx*float64(s.luts[ty0*s.tilesX+tx1][level])
+				bottom := (1-wx)*float64(s.luts[ty1*s.tilesX+tx0][level]) + wx*float64(s.luts[ty1*s.tilesX+tx1][level])
+				// The output is premultiplied by the alpha of the input.
+				rgb[c] = uint32((1-wy)*top+wy*bottom+0.5) * a / 0xffff
+			}
+			writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), uint16(rgb[0]), uint16(rgb[1]), uint16(rgb[2]), uint16(a))
+		}
+	}
+}
+
+// Return the two tiles along an axis of the given length whose centers surround the position,
+// and the weight of the second one.
+func tileWeights(pos int, length int, tiles int) (int, int, float64) {
+	f := (float64(pos)+0.5)*float64(tiles)/float64(length) - 0.5
+	if f <= 0 {
+		return 0, 0, 0
+	}
+	if f >= float64(tiles-1) {
+		return tiles - 1, tiles - 1, 0
+	}
+	t := int(f)
+	return t, t + 1, f - float64(t)
+}
+
+// Build the mapping of each tile from its clipped cumulative histogram.
+func (s *equalizeState) buildMappings() {
+	s.luts = make([][]uint16, len(s.hist))
+	for tile, hist := range s.hist {
+		s.luts[tile] = equalizeMapping(hist, s.effect.clip)
+	}
+}
+
+// Return the mapping of the intensity levels that equalizes the histogram. With a clip limit,
+// the bins above clip times the mean bin are cut and the excess is spread over all the bins.
+func equalizeMapping(hist []uint64, clip float64) []uint16 {
+	lut := make([]uint16, len(hist))
+	bins := make([]float64, len(hist))
+	total := float64(0)
+	for i, c := range hist {
+		bins[i] = float64(c)
+		total += bins[i]
+	}
+	if clip > 0 {
+		limit := clip * total / float64(len(bins))
+		excess := float64(0)
+		for i := range bins {
+			if bins[i] > limit {
+				excess += bins[i] - limit
+				bins[i] = limit
+			}
+		}
+		for i := range bins {
+			bins[i] += excess / float64(len(bins))
+		}
+	}
+	// The first populated level maps to black and the last one to white.
+	first := float64(0)
+	for _, c := range bins {
+		if c > 0 {
+			first = c
+			break
+		}
+	}
+	cdf := float64(0)
+	for i, c := range bins {
+		cdf += c
+		if total <= first {
+			// A tile with a single level, or no pixel, is left unchanged.
+			lut[i] = uint16(i * 0x101)
+		} else {
+			lut[i] = uint16(math.Max(0, cdf-first)/(total-first)*0xffff + 0.5)
+		}
+	}
+	return lut
+}
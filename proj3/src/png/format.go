@@ -0,0 +1,110 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"proj3/bmp"
+	"strings"
+)
+
+// A Format is an image file format that can be loaded and saved.
+type Format string
+
+const (
+	FormatPNG  Format = "png"
+	FormatJPEG Format = "jpeg"
+	FormatGIF  Format = "gif"
+	FormatBMP  Format = "bmp"
+)
+
+// The file extensions of each format, the first one is used when renaming files.
+var formatExtensions = map[Format][]string{
+	FormatPNG:  {".png"},
+	FormatJPEG: {".jpg", ".jpeg"},
+	FormatGIF:  {".gif"},
+	FormatBMP:  {".bmp"},
+}
+
+// The leading bytes identifying each format.
+var formatMagic = map[Format][]string{
+	FormatPNG:  {"\x89PNG\r\n\x1a\n"},
+	FormatJPEG: {"\xff\xd8\xff"},
+	FormatGIF:  {"GIF87a", "GIF89a"},
+	FormatBMP:  {"BM"},
+}
+
+// ParseFormat returns the format with the given name, e.g. "png" or "jpg".
+func ParseFormat(name string) (Format, error) {
+	if format, ok := FormatFromPath("." + name); ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("png: unknown image format %q", name)
+}
+
+// FormatFromPath returns the format given by the extension of the file path.
+func FormatFromPath(filePath string) (Format, bool) {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	for format, extensions := range formatExtensions {
+		for _, e := range extensions {
+			if ext == e {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ReplaceExt returns the file path with its extension replaced by the one of the format.
+func (f Format) ReplaceExt(filePath string) string {
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + formatExtensions[f][0]
+}
+
+// Return the format identified by the leading bytes of a file.
+func sniffFormat(header []byte) (Format, bool) {
+	for format, magics := range formatMagic {
+		for _, magic := range magics {
+			if bytes.HasPrefix(header, []byte(magic)) {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Decode an image in the given format.
+func decode(r io.Reader, format Format) (image.Image, error) {
+	switch format {
+	case FormatPNG:
+		return png.Decode(r)
+	case FormatJPEG:
+		return jpeg.Decode(r)
+	case FormatGIF:
+		return gif.Decode(r)
+	case FormatBMP:
+		return bmp.Decode(r)
+	}
+	return nil, fmt.Errorf("png: unknown image format %q", format)
+}
+
+// Encode an image in the given format.
+func encode(w io.Writer, m image.Image, format Format) error {
+	switch format {
+	case FormatPNG:
+		return png.Encode(w, m)
+	case FormatJPEG:
+		return jpeg.Encode(w, m, nil)
+	case FormatGIF:
+		return gif.Encode(w, m, nil)
+	case FormatBMP:
+		return bmp.Encode(w, m)
+	}
+	return fmt.Errorf("png: unknown image format %q", format)
+}
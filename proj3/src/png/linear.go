@@ -0,0 +1,233 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// A floatImage is a float plane of an image in linear light, holding the premultiplied rgba channels
+// of each pixel as float32 in the range of the 16-bit channels, so the effects keep their constants.
+type floatImage struct {
+	Pix    []float32 // 4 values per pixel in row-major order
+	Stride int       // The number of values in a row
+	Rect   image.Rectangle
+}
+
+// Return a float plane with the given bounds.
+func newFloatImage(bounds image.Rectangle) *floatImage {
+	return &floatImage{Pix: make([]float32, 4*bounds.Dx()*bounds.Dy()), Stride: 4 * bounds.Dx(), Rect: bounds}
+}
+
+// Return the offset in the float plane of the pixel at the image slice position k,
+// where n is the number of pixels in a row.
+func floatOffset(k int, n int, stride int) int {
+	return (k/n)*stride + (k%n)*4
+}
+
+// Read the rgba channels of the pixel at offset i of a float plane.
+func readFloat(pix []float32, i int) (float64, float64, float64, float64) {
+	s := pix[i : i+4 : i+4]
+	return float64(s[0]), float64(s[1]), float64(s[2]), float64(s[3])
+}
+
+// Write the rgba channels of the pixel at offset i of a float plane.
+func writeFloat(pix []float32, i int, r float64, g float64, b float64, a float64) {
+	s := pix[i : i+4 : i+4]
+	s[0], s[1], s[2], s[3] = float32(r), float32(g), float32(b), float32(a)
+}
+
+// Limit a channel of a float plane to the range of the 16-bit channels, like clamp without rounding.
+func clampFloat(v float64) float64 {
+	return math.Max(0, math.Min(v, 0xffff))
+}
+
+// The linear light in [0, 1] of each 16-bit sRGB value, built on first use.
+var (
+	transferOnce sync.Once
+	toLinear     []float32
+)
+
+// Return the table of the linear light of the 16-bit sRGB values.
+func linearTable() []float32 {
+	transferOnce.Do(func() {
+		toLinear = make([]float32, 1<<16)
+		for v := range toLinear {
+			toLinear[v] = float32(srgbDecode(float64(v) / 0xffff))
+		}
+	})
+	return toLinear
+}
+
+// Return the linear light of the sRGB value v in [0, 1].
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Return the sRGB value of the linear light v in [0, 1].
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// Convert the image to linear light, taking its float planes from the pool.
+// The input buffer is converted into the input plane by the given number of goroutines.
+func (img *Image) toLinear(threads int) {
+	img.linear = true
+	img.fin = img.pool.getFloat(img.in.Bounds())
+	img.fout = img.pool.getFloat(img.in.Bounds())
+	inBands(img.in.Bounds().Dy(), threads, func(yStart int, yEnd int) {
+		n := img.in.Bounds().Dx()
+		decodeSRGB(img.fin, img.in, yStart*n, yEnd*n)
+	})
+}
+
+// Split the rows from 0 to height in bands converted by the given number of goroutines.
+func inBands(height int, threads int, convert func(yStart int, yEnd int)) {
+	if threads <= 1 {
+		convert(0, height)
+		return
+	}
+	var wg sync.WaitGroup
+	rowsPerThread := (height + threads - 1) / threads
+	for yStart := 0; yStart < height; yStart += rowsPerThread {
+		yEnd := yStart + rowsPerThread
+		if yEnd > height {
+			yEnd = height
+		}
+		wg.Add(1)
+		go func(yStart int, yEnd int) {
+			defer wg.Done()
+			convert(yStart, yEnd)
+		}(yStart, yEnd)
+	}
+	wg.Wait()
+}
+
+// Write the linear light of the 16-bit sRGB pixels of src into dst, which has the same bounds,
+// from start to end position. The colors are converted without their alpha, which is kept.
+func decodeSRGB(dst *floatImage, src *image.RGBA64, start int, end int) {
+	table := linearTable()
+	n := src.Bounds().Dx()
+	for k := start; k < end; k++ {
+		r, g, b, a := readPixel(src.Pix, pixOffset(k, n, src.Stride))
+		r, g, b = unpremultiply(r, g, b, a)
+		af := float64(a)
+		writeFloat(dst.Pix, floatOffset(k, n, dst.Stride), float64(table[r])*af, float64(table[g])*af, float64(table[b])*af, af)
+	}
+}
+
+// Write the 16-bit sRGB pixels of the linear light of src into dst, which has the same bounds,
+// from start to end position, rounded to the nearest values before and after premultiplication.
+func encodeSRGB(dst *image.RGBA64, src *floatImage, start int, end int) {
+	n := dst.Bounds().Dx()
+	for k := start; k < end; k++ {
+		r, g, b, a := readFloat(src.Pix, floatOffset(k, n, src.Stride))
+		a16 := uint32(clamp(math.Round(a)))
+		rgb := [3]uint32{}
+		if a16 != 0 {
+			for c, v := range [3]float64{r, g, b} {
+				srgb := math.Round(srgbEncode(math.Max(0, math.Min(v/a, 1))) * 0xffff)
+				rgb[c] = uint32(math.Round(srgb * float64(a16) / 0xffff))
+			}
+		}
+		writePixel(dst.Pix, pixOffset(k, n, dst.Stride), uint16(rgb[0]), uint16(rgb[1]), uint16(rgb[2]), uint16(a16))
+	}
+}
+
+// Return the stride of the input plane and the length of its pixels if linear,
+// or those of the input buffer.
+func (img *Image) inputLayout(linear bool) (int, int) {
+	if linear {
+		return img.fin.Stride, 4
+	}
+	return img.in.Stride, 8
+}
+
+// Read the rgba channels of the pixel at offset i of the input plane if linear,
+// or of the input buffer.
+func (img *Image) readInput(i int, linear bool) (float64, float64, float64, float64) {
+	if linear {
+		return readFloat(img.fin.Pix, i)
+	}
+	r, g, b, a := readPixel(img.in.Pix, i)
+	return float64(r), float64(g), float64(b), float64(a)
+}
+
+// Report whether the effect is applied to the float planes of the image.
+func (img *Image) appliesLinear(effect Effect) bool {
+	_, ok := effect.(LinearEffect)
+	return img.linear && ok
+}
+
+// Copy the image slice from start to end position from the input plane to the output plane.
+func (img *Image) copyThroughLinear(start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	for k := start; k < end; {
+		rowEnd := (k/n + 1) * n
+		if rowEnd > end {
+			rowEnd = end
+		}
+		inOff, outOff := floatOffset(k, n, img.fin.Stride), floatOffset(k, n, img.fout.Stride)
+		copy(img.fout.Pix[outOff:outOff+(rowEnd-k)*4], img.fin.Pix[inOff:])
+		k = rowEnd
+	}
+}
+
+// A linearStage applies a stage of a LinearEffect to the float planes of an image in linear light.
+type linearStage struct {
+	LinearEffect
+}
+
+func (s *linearStage) Apply(img *Image, start int, end int) {
+	s.ApplyLinear(img, start, end)
+}
+
+// A transferStage converts the input plane of an image in linear light to the sRGB values of its
+// output buffer, before the stages of an effect applied to them, or converts their result back
+// to the output plane afterwards.
+type transferStage struct {
+	effect Effect
+	encode bool // Convert from the linear light, or back to it otherwise
+}
+
+func (s *transferStage) Name() string { return s.effect.Name() }
+
+func (s *transferStage) Params() map[string]any {
+	return s.effect.Params()
+}
+
+func (s *transferStage) Radius() int { return 0 }
+
+func (s *transferStage) Apply(img *Image, start int, end int) {
+	if s.encode {
+		encodeSRGB(img.out, img.fin, start, end)
+	} else {
+		decodeSRGB(img.fout, img.in, start, end)
+	}
+}
+
+// Return the image whose output buffer holds the sRGB values to save, which is the image itself
+// unless it is in linear light. The buffer of a converted image is released to the pool by the
+// returned function.
+func (img *Image) encoded(options SaveOptions) (*Image, func()) {
+	if !img.linear {
+		return img, func() {}
+	}
+	saved := *img
+	saved.linear = false
+	saved.out = img.pool.get(img.fout.Rect)
+	inBands(img.fout.Rect.Dy(), options.Threads, func(yStart int, yEnd int) {
+		n := img.fout.Rect.Dx()
+		encodeSRGB(saved.out, img.fout, yStart*n, yEnd*n)
+	})
+	return &saved, func() { img.pool.put(saved.out) }
+}
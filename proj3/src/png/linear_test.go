@@ -0,0 +1,214 @@
+package png
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestSRGBTransfer(t *testing.T) {
+	for _, v := range []float64{0, 0.002, 0.04, 0.2, 0.5, 0.9, 1} {
+		if back := srgbEncode(srgbDecode(v)); math.Abs(back-v) > 1e-12 {
+			t.Errorf("FAILED: sRGB value %v is %v through linear light", v, back)
+		}
+	}
+	// Every 16-bit value is kept through the float planes, with or without alpha.
+	src := newTestImage(256, 256)
+	for k := 0; k < 1<<16; k++ {
+		a := uint16(0xffff)
+		if k%2 == 1 {
+			a = 0x8000
+		}
+		v := uint16(uint32(k) * uint32(a) / 0xffff)
+		writePixel(src.in.Pix, k*8, v, v, v, a)
+	}
+	linear := newFloatImage(src.in.Bounds())
+	decodeSRGB(linear, src.in, 0, 1<<16)
+	encodeSRGB(src.out, linear, 0, 1<<16)
+	for k := 0; k < 1<<16; k++ {
+		r, _, _, a := readPixel(src.out.Pix, k*8)
+		if r0, _, _, a0 := readPixel(src.in.Pix, k*8); r != r0 || a != a0 {
+			t.Fatalf("FAILED: pixel %x,%x is %x,%x through linear light", r0, a0, r, a)
+		}
+	}
+	if gray := linearTable()[0x8080]; gray >= 0.25 {
+		t.Errorf("FAILED: linear light of the sRGB middle gray is %v", gray)
+	}
+}
+
+func TestLinearLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	source := newTestImage(13, 9)
+	source.Swap()
+	if err := source.SaveWithOptions(filepath.Join(dir, "source.png"), SaveOptions{BitDepth: 8}); err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	expected, err := Load(filepath.Join(dir, "source.png"))
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+
+	// An image loaded in linear light is saved back to the same sRGB values.
+	for _, threads := range []int{1, 4} {
+		pool := NewPool()
+		img, err := LoadWithOptions(filepath.Join(dir, "source.png"), LoadOptions{Linear: true, Threads: threads, Pool: pool})
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		if img.fin == nil || img.fin.Rect != img.in.Bounds() {
+			t.Fatalf("FAILED: image loaded in linear light has no float planes")
+		}
+		img.Swap()
+		if err := img.SaveWithOptions(filepath.Join(dir, "linear.png"), SaveOptions{Threads: threads}); err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		saved, err := Load(filepath.Join(dir, "linear.png"))
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		if !bytes.Equal(saved.in.Pix, expected.in.Pix) {
+			t.Errorf("FAILED: image saved from linear light with %v threads differs", threads)
+		}
+		// The float planes go back to the pool, along with the buffers.
+		img.Release()
+		if stats := pool.Stats(); stats.Allocated != 5 {
+			t.Errorf("FAILED: linear image allocated %v buffers, expected 5", stats.Allocated)
+		}
+	}
+}
+
+// Return the test image with a translucent left third, in linear light if linear, where the float planes
+// hold the values of the 16-bit buffers, so that the float path of an effect compares with the 16-bit one.
+func newTranslucentImage(w int, h int, linear bool) *Image {
+	img := newTestImage(w, h)
+	for k := 0; k < w*h; k++ {
+		if k%w < w/3 {
+			r, g, b, _ := readPixel(img.in.Pix, k*8)
+			writePixel(img.in.Pix, k*8, uint16(r*0x8000/0xffff), uint16(g*0x8000/0xffff), uint16(b*0x8000/0xffff), 0x8000)
+		}
+	}
+	if linear {
+		img.linear = true
+		img.fin, img.fout = newFloatImage(img.Bounds), newFloatImage(img.Bounds)
+		for k := 0; k < w*h; k++ {
+			r, g, b, a := readPixel(img.in.Pix, k*8)
+			writeFloat(img.fin.Pix, k*4, float64(r), float64(g), float64(b), float64(a))
+		}
+	}
+	return img
+}
+
+func TestLinearEffectsMatch16Bit(t *testing.T) {
+	effects := []struct {
+		name   string
+		params map[string]any
+	}{
+		{"blur", map[string]any{"border": "zero"}},
+		{"blur", map[string]any{"radius": 3, "border": "renormalize"}},
+		{"sharpen", map[string]any{"border": "mirror"}},
+		{"edge", map[string]any{"border": "wrap"}},
+		{"kernel", map[string]any{"matrix": []any{0.0, 1.0, 0.0, 1.0, 2.0, 1.0, 0.0, 1.0, 0.0}, "divisor": 6, "bias": 0.1, "channels": "gb"}},
+		{"gaussian", map[string]any{"sigma": 1.5, "border": "clamp"}},
+		{"boxblur", map[string]any{"radius": 2}},
+		{"unsharp", map[string]any{"radius": 1.2, "amount": 0.8}},
+		{"grayscale", nil},
+		{"sepia", map[string]any{"amount": 0.5}},
+		{"invert", nil},
+		{"matrix", map[string]any{"matrix": []any{1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.5, 0.25}}},
+		{"resize", map[string]any{"width": 9, "filter": "bicubic"}},
+		{"rotate", map[string]any{"degrees": 30, "filter": "lanczos"}},
+		{"flip", map[string]any{"direction": "both"}},
+		{"crop", map[string]any{"x": 3, "y": 2, "width": 8, "height": 5}},
+		{"warp", map[string]any{"matrix": []any{1.0, 0.2, -1.0, 0.1, 1.0, 0.0, 0.01, 0.0, 1.0}, "filter": "nearest"}},
+		{"brightness", map[string]any{"amount": 0.1}},
+		{"contrast", map[string]any{"factor": 1.5}},
+		{"gamma", map[string]any{"gamma": 1.25}},
+		{"saturation", map[string]any{"factor": 0.5}},
+		{"hue", map[string]any{"degrees": 120}},
+		{"median", map[string]any{"radius": 2, "border": "zero"}},
+		{"bilateral", map[string]any{"sigmaSpatial": 1, "sigmaRange": 0.2}},
+		{"sobel", map[string]any{"border": "clamp"}},
+		{"prewitt", nil},
+	}
+	for _, c := range effects {
+		effect, err := NewEffect(c.name, c.params)
+		if err != nil {
+			t.Fatalf("FAILED: %v", err)
+		}
+		if _, ok := effect.(LinearEffect); !ok {
+			t.Fatalf("FAILED: %v is not applied in linear light", c.name)
+		}
+		expected := newTranslucentImage(17, 11, false)
+		applyStages(expected, effect, 17*11)
+		img := newTranslucentImage(17, 11, true)
+		applyStages(img, effect, 23)
+		if img.fout.Rect != expected.out.Bounds() {
+			t.Fatalf("FAILED: %v in linear light has bounds %v, expected %v", c.name, img.fout.Rect, expected.out.Bounds())
+		}
+		// The 16-bit channels are truncated or rounded where the float ones are not, after each of the stages.
+		for k := 0; k < len(img.fout.Pix)/4; k++ {
+			r, g, b, a := readFloat(img.fout.Pix, k*4)
+			r16, g16, b16, a16 := readPixel(expected.out.Pix, k*8)
+			got, want := [4]float64{r, g, b, a}, [4]uint32{r16, g16, b16, a16}
+			for i := range got {
+				if math.Abs(got[i]-float64(want[i])) > 2 {
+					t.Fatalf("FAILED: %v pixel %v in linear light is %v,%v,%v,%v, expected %v,%v,%v,%v",
+						c.name, k, r, g, b, a, r16, g16, b16, a16)
+				}
+			}
+		}
+	}
+}
+
+func TestLinearBlur(t *testing.T) {
+	// Blurring an edge in linear light keeps the light of both sides, brighter than in sRGB.
+	step := func(x int, y int) uint16 {
+		if x < 5 {
+			return 0
+		}
+		return 0xffff
+	}
+	effect, _ := NewEffect("blur", map[string]any{"border": "clamp"})
+	srgb := newStepImage(10, 3, step)
+	applyStages(srgb, effect, 30)
+	img := newStepImage(10, 3, step)
+	img.toLinear(1)
+	applyStages(img, effect, 30)
+	saved, release := img.encoded(SaveOptions{})
+	defer release()
+	if saved.linear || img.out == saved.out {
+		t.Fatalf("FAILED: image in linear light saved without conversion")
+	}
+	for x := 4; x < 6; x++ {
+		if p, q := outPixel(saved, x, 1), outPixel(srgb, x, 1); p[0] <= q[0] || p[3] != 0xffff {
+			t.Errorf("FAILED: pixel %v blurred in linear light is %v, in sRGB %v", x, p, q)
+		}
+	}
+}
+
+func TestLinearFallback(t *testing.T) {
+	// An effect without a linear light path is applied to the sRGB values, between the conversions.
+	effect, _ := NewEffect("equalize", nil)
+	img := newTranslucentImage(17, 11, false)
+	img.toLinear(1)
+	stages := Stages(effect, img)
+	_, first := stages[0].(*transferStage)
+	_, last := stages[len(stages)-1].(*transferStage)
+	// The two stages of the equalization are applied between the conversions.
+	if !first || !last || len(stages) != 4 {
+		t.Fatalf("FAILED: equalize in linear light has stages %v", stages)
+	}
+	applyStages(img, effect, 23)
+	expected := newTranslucentImage(17, 11, false)
+	applyStages(expected, effect, 17*11)
+	saved, release := img.encoded(SaveOptions{})
+	defer release()
+	for i := 0; i < len(saved.out.Pix); i += 8 {
+		r, g, b, a := readPixel(saved.out.Pix, i)
+		r16, g16, b16, a16 := readPixel(expected.out.Pix, i)
+		if absDiff(r, r16) > 1 || absDiff(g, g16) > 1 || absDiff(b, b16) > 1 || a != a16 {
+			t.Fatalf("FAILED: equalize pixel %v in linear light is %v,%v,%v,%v, expected %v,%v,%v,%v", i/8, r, g, b, a, r16, g16, b16, a16)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package png
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMatrixPresets(t *testing.T) {
+	// The grayscale preset is the grayscale method.
+	effect, _ := NewEffect("G", nil)
+	expected := newTestImage(9, 7)
+	expected.Grayscale(0, 63)
+	img := newTestImage(9, 7)
+	effect.Apply(img, 0, 63)
+	if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+		t.Errorf("FAILED: grayscale preset differs from the grayscale method")
+	}
+	// The same matrix given in effects.txt.
+	matrix := []any{1.0, 1.0, 1.0, 0.0, 1.0, 1.0, 1.0, 0.0, 1.0, 1.0, 1.0, 0.0}
+	effect, err := NewEffect("matrix", map[string]any{"matrix": matrix, "divisor": 3})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	if err := ValidateEffect(effect); err != nil {
+		t.Errorf("FAILED: %v", err)
+	}
+	img = newTestImage(9, 7)
+	effect.Apply(img, 0, 63)
+	if !bytes.Equal(img.out.Pix, expected.out.Pix) {
+		t.Errorf("FAILED: grayscale matrix differs from the grayscale method")
+	}
+
+	// Inverting twice is the identity, also on translucent pixels.
+	effect, _ = NewEffect("invert", nil)
+	img = newTestImage(9, 7)
+	writePixel(img.in.Pix, 16, 0x1000, 0x4000, 0x7000, 0x8000)
+	original := append([]byte(nil), img.in.Pix...)
+	effect.Apply(img, 0, 63)
+	if r, g, b, a := readPixel(img.out.Pix, 16); r != 0x7000 || g != 0x4000 || b != 0x1000 || a != 0x8000 {
+		t.Errorf("FAILED: translucent pixel inverts to %x %x %x %x", r, g, b, a)
+	}
+	img.Swap()
+	effect.Apply(img, 0, 63)
+	if !bytes.Equal(img.out.Pix, original) {
+		t.Errorf("FAILED: inverting twice changes the image")
+	}
+
+	// A sepia of amount 0 is the identity.
+	effect, _ = NewEffect("sepia", map[string]any{"amount": 0})
+	img = newTestImage(9, 7)
+	effect.Apply(img, 0, 63)
+	if !bytes.Equal(img.out.Pix, img.in.Pix) {
+		t.Errorf("FAILED: sepia of amount 0 changes the image")
+	}
+}
+
+func TestMatrixAlpha(t *testing.T) {
+	// A 4x5 matrix halving alpha and setting red.
+	matrix := []any{0.0, 0.0, 0.0, 0.0, 1.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.5, 0.0}
+	effect, err := NewEffect("matrix", map[string]any{"matrix": matrix})
+	if err != nil {
+		t.Fatalf("FAILED: %v", err)
+	}
+	img := newStepImage(1, 1, func(x int, y int) uint16 { return 0 })
+	writePixel(img.in.Pix, 0, 0, 0x8000, 0x4000, 0xffff)
+	effect.Apply(img, 0, 1)
+	if r, g, b, a := readPixel(img.out.Pix, 0); r != 0x7fff || g != 0x3fff || b != 0x1fff || a != 0x7fff {
+		t.Errorf("FAILED: matrix maps the pixel to %x %x %x %x", r, g, b, a)
+	}
+
+	invalid := []map[string]any{
+		{},
+		{"matrix": []any{1.0, 2.0}},
+		{"matrix": []any{"1", 0.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 0.0, 1.0, 0.0}},
+		{"matrix": identityMatrix, "divisor": 0},
+	}
+	for _, params := range invalid {
+		if _, err := NewEffect("matrix", params); err == nil {
+			t.Errorf("FAILED: matrix with %v should be rejected", params)
+		}
+	}
+}
+
+func TestPosterize(t *testing.T) {
+	effect, _ := NewEffect("posterize", map[string]any{"levels": 3})
+	img := newStepImage(5, 1, func(x int, y int) uint16 { return []uint16{0, 0x3000, 0x5000, 0xd000, 0xffff}[x] })
+	effect.Apply(img, 0, 5)
+	for x, want := range []uint32{0, 0, 0x8000, 0xffff, 0xffff} {
+		if r, _, _, _ := readPixel(img.out.Pix, x*8); absDiff(r, want) > 1 {
+			t.Errorf("FAILED: posterized pixel %v is %x, expected %x", x, r, want)
+		}
+	}
+}
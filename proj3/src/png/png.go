@@ -3,40 +3,145 @@
 package png
 
 import (
+	"bufio"
+	"fmt"
 	"image"
-	"image/color"
-	"image/png"
-	"math"
 	"os"
 )
 
 // The Image represents a structure for working with PNG images.
+// Images can also be loaded from and saved to the other supported formats (JPEG, GIF and BMP).
 type Image struct {
-	in     *image.RGBA64   //The original pixels before applying the effect
-	out    *image.RGBA64   //The updated pixels after applying the effect
-	Bounds image.Rectangle //The size of the image
+	in      *image.RGBA64   //The original pixels before applying the effect
+	out     *image.RGBA64   //The updated pixels after applying the effect
+	Bounds  image.Rectangle //The size of the image
+	depth   int             //The bit depth per channel of the loaded file, 8 or 16
+	pool    *Pool           //The pool the buffers are taken from and released to, if any
+	planes  []*image.RGBA64 //The scratch planes of the effect being applied
+	linear  bool            //The image was loaded in linear light, which the float planes hold
+	fin     *floatImage     //The linear light of the input buffer, nil unless linear
+	fout    *floatImage     //The linear light of the output buffer, nil unless linear
+	fplanes []*floatImage   //The float scratch planes of the effect being applied in linear light
 }
 
 // Public functions
-
-// Swap the in and out image pointer.
+//
+// Swap the in and out image pointer, and the float planes of an image in linear light.
+// If an effect changed the bounds of the image, the new output buffer is reallocated
+// with the bounds of the new input buffer.
 func (img *Image) Swap() {
 	imgPointer := img.in
 	img.in = img.out
 	img.out = imgPointer
+	if img.out.Bounds() != img.in.Bounds() {
+		img.pool.put(img.out)
+		img.out = img.pool.get(img.in.Bounds())
+	}
+	if img.linear {
+		img.fin, img.fout = img.fout, img.fin
+		if img.fout.Rect != img.fin.Rect {
+			img.pool.putFloat(img.fout)
+			img.fout = img.pool.getFloat(img.fin.Rect)
+		}
+	}
+	img.Bounds = img.in.Bounds()
+}
+
+// AllocatePlanes takes the scratch planes of a ScratchEffect from the pool of the image,
+// with the bounds of the image, before its stages are applied. The pixels of the planes are undefined.
+// An effect applied in linear light takes float planes instead.
+func (img *Image) AllocatePlanes(effect Effect) {
+	scratch, ok := effect.(ScratchEffect)
+	if !ok {
+		return
+	}
+	for i := 0; i < scratch.ScratchPlanes(); i++ {
+		if img.appliesLinear(effect) {
+			img.fplanes = append(img.fplanes, img.pool.getFloat(img.in.Bounds()))
+		} else {
+			img.planes = append(img.planes, img.pool.get(img.in.Bounds()))
+		}
+	}
+}
+
+// ReleasePlanes returns the scratch planes to the pool once the stages of the effect are applied.
+func (img *Image) ReleasePlanes() {
+	for _, plane := range img.planes {
+		img.pool.put(plane)
+	}
+	for _, plane := range img.fplanes {
+		img.pool.putFloat(plane)
+	}
+	img.planes, img.fplanes = nil, nil
+}
+
+// Prepare the output buffer for applying the effect, reallocating it with the bounds of
+// a GeometricEffect, and return the number of output pixels the effect is applied to.
+func (img *Image) Prepare(effect Effect) int {
+	if stage, ok := effect.(*linearStage); ok {
+		effect = stage.LinearEffect
+	}
+	if geometric, ok := effect.(GeometricEffect); ok {
+		bounds := geometric.OutputBounds(img.in.Bounds())
+		if bounds != img.out.Bounds() {
+			img.pool.put(img.out)
+			img.out = img.pool.get(bounds)
+		}
+		if img.linear && bounds != img.fout.Rect {
+			img.pool.putFloat(img.fout)
+			img.fout = img.pool.getFloat(bounds)
+		}
+		img.Bounds = bounds
+	}
+	return img.out.Bounds().Dx() * img.out.Bounds().Dy()
+}
+
+// SaveOptions control how an image is saved.
+// The bit depth, alpha, compression and palette options only apply to PNG files.
+type SaveOptions struct {
+	Format           Format // The file format, given by the file extension if empty
+	BitDepth         int    // 1, 8 or 16 bits per channel, the bit depth of the loaded file if 0, 1 bit saves black and white
+	KeepAlpha        bool   // Keep the alpha channel even if the image is fully opaque
+	CompressionLevel int    // The zlib level from 1 (best speed) to 9 (best compression), NoCompression, or 0 for the default
+	Grayscale        bool   // Save a single gray channel, the image must have equal rgb channels
+	Palette          bool   // Save an 8-bit paletted image if the image has at most 256 colors
+	Threads          int    // The number of goroutines compressing a PNG file, serial if at most 1
+}
+
+// LoadOptions control how an image is loaded.
+type LoadOptions struct {
+	Threads int   // The number of goroutines converting the decoded image, serial if at most 1
+	Pool    *Pool // The pool the image buffers are taken from, allocated if nil
+	Linear  bool  // Hold the image in float planes of linear light, which the LinearEffects work on, until it is saved
 }
 
 // Load returns a Image that was loaded based on the filePath parameter.
+// The format is identified by the leading bytes of the file, or by its extension otherwise.
 func Load(filePath string) (*Image, error) {
+	return LoadWithOptions(filePath, LoadOptions{})
+}
+
+// LoadWithOptions returns a Image that was loaded based on the filePath parameter as specified by the options.
+func LoadWithOptions(filePath string, options LoadOptions) (*Image, error) {
 
-	inReader, err := os.Open(filePath)
+	inFile, err := os.Open(filePath)
 
 	if err != nil {
 		return nil, err
 	}
-	defer inReader.Close()
+	defer inFile.Close()
+
+	inReader := bufio.NewReader(inFile)
+	header, _ := inReader.Peek(8)
+	format, ok := sniffFormat(header)
+	if !ok {
+		format, ok = FormatFromPath(filePath)
+	}
+	if !ok {
+		return nil, fmt.Errorf("png: unknown image format of %v", filePath)
+	}
 
-	inOrig, err := png.Decode(inReader)
+	inOrig, err := decode(inReader, format)
 
 	if err != nil {
 		return nil, err
@@ -44,19 +149,19 @@ func Load(filePath string) (*Image, error) {
 
 	bounds := inOrig.Bounds()
 
-	outImg := image.NewRGBA64(bounds)
-	inImg := image.NewRGBA64(bounds)
+	outImg := options.Pool.get(bounds)
+	inImg := options.Pool.get(bounds)
+	convert(inImg, inOrig, options.Threads)
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := inOrig.At(x, y).RGBA()
-			inImg.Set(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
-		}
-	}
 	task := &Image{}
 	task.in = inImg
 	task.out = outImg
 	task.Bounds = bounds
+	task.depth = bitDepth(inOrig)
+	task.pool = options.Pool
+	if options.Linear {
+		task.toLinear(options.Threads)
+	}
 	return task, nil
 }
 
@@ -66,8 +171,24 @@ func (img *Image) GetBounds() (YMin int, YMax int, XMin int, XMax int) {
 	return bounds.Min.Y, bounds.Max.Y, bounds.Min.X, bounds.Max.X
 }
 
-// Save saves the image to the given file.
+// Save saves the image to the given file, in the format given by the file extension.
+// Files without a known extension are saved as PNG.
 func (img *Image) Save(filePath string) error {
+	return img.SaveWithOptions(filePath, SaveOptions{})
+}
+
+// SaveWithOptions saves the image to the given file as specified by the options.
+// An image loaded in linear light is converted back to sRGB.
+func (img *Image) SaveWithOptions(filePath string, options SaveOptions) error {
+	format := options.Format
+	if format == "" {
+		format, _ = FormatFromPath(filePath)
+	}
+	if format == "" {
+		format = FormatPNG
+	}
+	img, release := img.encoded(options)
+	defer release()
 
 	outWriter, err := os.Create(filePath)
 	if err != nil {
@@ -75,15 +196,89 @@ func (img *Image) Save(filePath string) error {
 	}
 	defer outWriter.Close()
 
-	err = png.Encode(outWriter, img.out)
+	if format == FormatPNG {
+		err = img.encodePNG(outWriter, options)
+	} else {
+		err = encode(outWriter, img.outputImage(options), format)
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Return the output buffer as the image to encode in a format other than PNG.
+func (img *Image) outputImage(options SaveOptions) image.Image {
+	if !options.Grayscale {
+		return img.out
+	}
+	gray := image.NewGray(img.out.Bounds())
+	pix := img.out.Pix
+	for i := range gray.Pix {
+		r, _, _, _ := readPixel(pix, i*8)
+		gray.Pix[i] = to8Bit(r)
+	}
+	return gray
+}
+
+// Return the bit depth per channel of a decoded image.
+func bitDepth(m image.Image) int {
+	switch m.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return 16
+	}
+	return 8
+}
+
+// Return the offset in the Pix buffer of the pixel at (x, y) of the image slice
+// position k, where n is the number of pixels in a row.
+func pixOffset(k int, n int, stride int) int {
+	return (k/n)*stride + (k%n)*8
+}
+
+// Copy the image slice from start to end position from the input buffer to the output buffer.
+func (img *Image) copyThrough(start int, end int) {
+	_, _, xMin, xMax := img.GetBounds()
+	n := xMax - xMin
+	for k := start; k < end; {
+		// Copy the rest of the row at once.
+		rowEnd := (k/n + 1) * n
+		if rowEnd > end {
+			rowEnd = end
+		}
+		inOff, outOff := pixOffset(k, n, img.in.Stride), pixOffset(k, n, img.out.Stride)
+		copy(img.out.Pix[outOff:outOff+(rowEnd-k)*8], img.in.Pix[inOff:])
+		k = rowEnd
+	}
+}
+
+// Read the 16-bit rgba channels of the pixel at offset i of a RGBA64 Pix buffer.
+func readPixel(pix []uint8, i int) (r uint32, g uint32, b uint32, a uint32) {
+	s := pix[i : i+8 : i+8]
+	r = uint32(s[0])<<8 | uint32(s[1])
+	g = uint32(s[2])<<8 | uint32(s[3])
+	b = uint32(s[4])<<8 | uint32(s[5])
+	a = uint32(s[6])<<8 | uint32(s[7])
+	return
+}
+
+// Write the 16-bit rgba channels of the pixel at offset i of a RGBA64 Pix buffer.
+func writePixel(pix []uint8, i int, r uint16, g uint16, b uint16, a uint16) {
+	s := pix[i : i+8 : i+8]
+	s[0], s[1] = uint8(r>>8), uint8(r)
+	s[2], s[3] = uint8(g>>8), uint8(g)
+	s[4], s[5] = uint8(b>>8), uint8(b)
+	s[6], s[7] = uint8(a>>8), uint8(a)
+}
+
 // clamp will clamp the comp parameter to zero if it is less than zero or to 65535 if the comp parameter
 // is greater than 65535.
 func clamp(comp float64) uint16 {
-	return uint16(math.Min(65535, math.Max(0, comp)))
+	if comp < 0 {
+		return 0
+	}
+	if comp > 65535 {
+		return 65535
+	}
+	return uint16(comp)
 }
@@ -0,0 +1,33 @@
+package png
+
+import (
+	"image"
+	"testing"
+)
+
+func TestPoolReusesBuffers(t *testing.T) {
+	pool := NewPool()
+	big := pool.get(image.Rect(0, 0, 20, 10))
+	small := pool.get(image.Rect(0, 0, 5, 5))
+	pool.put(big)
+	pool.put(small)
+
+	// The smallest free buffer that fits is reused, with the new bounds.
+	m := pool.get(image.Rect(2, 3, 6, 7))
+	if &m.Pix[:cap(m.Pix)][0] != &small.Pix[0] {
+		t.Errorf("FAILED: the smallest free buffer should be reused")
+	}
+	if m.Stride != 32 || len(m.Pix) != 128 || m.Bounds() != image.Rect(2, 3, 6, 7) {
+		t.Errorf("FAILED: reused image has stride %v, length %v and bounds %v", m.Stride, len(m.Pix), m.Bounds())
+	}
+	m.SetRGBA64(5, 6, m.RGBA64At(5, 6))
+
+	// No free buffer is large enough.
+	pool.get(image.Rect(0, 0, 30, 30))
+	stats := pool.Stats()
+	// The reused buffer and the new one are in use at the same time.
+	expected := PoolStats{Allocated: 3, Reused: 1, PeakBytes: 8 * (5*5 + 30*30), HeldBytes: 8 * (20*10 + 5*5 + 30*30)}
+	if stats != expected {
+		t.Errorf("FAILED: pool stats %+v, expected %+v", stats, expected)
+	}
+}
@@ -0,0 +1,232 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// An interpolation filter, whose weight is zero beyond its radius.
+type filter struct {
+	name   string
+	radius float64
+	weight func(t float64) float64
+}
+
+// The interpolation filters by name. The nearest filter picks the pixel under the position.
+var filters = map[string]*filter{
+	"nearest":  {name: "nearest"},
+	"bilinear": {name: "bilinear", radius: 1, weight: triangle},
+	"bicubic":  {name: "bicubic", radius: 2, weight: catmullRom},
+	"lanczos":  {name: "lanczos", radius: 3, weight: lanczos3},
+}
+
+// Return the interpolation filter given by the parameter key, bilinear if it is absent.
+func paramFilter(params map[string]any, key string) (*filter, error) {
+	v, ok := params[key]
+	if !ok {
+		return filters["bilinear"], nil
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("png: parameter %q must be a string, got %v", key, v)
+	}
+	f, ok := filters[name]
+	if !ok {
+		return nil, fmt.Errorf("png: unknown interpolation filter %q", name)
+	}
+	return f, nil
+}
+
+func triangle(t float64) float64 {
+	t = math.Abs(t)
+	if t < 1 {
+		return 1 - t
+	}
+	return 0
+}
+
+// The cubic convolution with a = -0.5.
+func catmullRom(t float64) float64 {
+	t = math.Abs(t)
+	switch {
+	case t < 1:
+		return (1.5*t-2.5)*t*t + 1
+	case t < 2:
+		return ((-0.5*t+2.5)*t-4)*t + 2
+	}
+	return 0
+}
+
+func lanczos3(t float64) float64 {
+	t = math.Abs(t)
+	switch {
+	case t == 0:
+		return 1
+	case t < 3:
+		pt := math.Pi * t
+		return 3 * math.Sin(pt) * math.Sin(pt/3) / (pt * pt)
+	}
+	return 0
+}
+
+// A sampler interpolates the pixels of an image at continuous positions, where the center of
+// the pixel (x, y) is at (x+0.5, y+0.5). The filter is widened by the scale along each axis
+// to average the pixels of a shrunk image. A sampler is not safe for concurrent use.
+type sampler struct {
+	src            *image.RGBA64
+	fsrc           *floatImage // The float plane sampled instead of src in linear light
+	bounds         image.Rectangle
+	stride, step   int // The offsets of the next row and of the next pixel of the sampled buffer
+	filter         *filter
+	border         Border
+	scaleX, scaleY float64
+	offsX, offsY   []int     // The Pix offsets of the neighbours along each axis, -1 if skipped
+	wX, wY         []float64 // The weights of the neighbours along each axis
+}
+
+// Return a sampler of src, where scales below 1 are raised to 1.
+func newSampler(src *image.RGBA64, f *filter, border Border, scaleX float64, scaleY float64) *sampler {
+	return &sampler{src: src, bounds: src.Bounds(), stride: src.Stride, step: 8,
+		filter: f, border: border, scaleX: math.Max(scaleX, 1), scaleY: math.Max(scaleY, 1)}
+}
+
+// Return a sampler of the float plane src, like newSampler.
+func newFloatSampler(src *floatImage, f *filter, border Border, scaleX float64, scaleY float64) *sampler {
+	return &sampler{fsrc: src, bounds: src.Rect, stride: src.Stride, step: 4,
+		filter: f, border: border, scaleX: math.Max(scaleX, 1), scaleY: math.Max(scaleY, 1)}
+}
+
+// Return the premultiplied color interpolated at (x, y). Neighbours outside of the image are read
+// according to the border policy. The overshoot of the filters with negative weights is clamped.
+func (s *sampler) at(x float64, y float64) (uint16, uint16, uint16, uint16) {
+	if s.filter.radius == 0 {
+		i, ok := s.nearest(x, y)
+		if !ok {
+			return 0, 0, 0, 0
+		}
+		r, g, bl, a := readPixel(s.src.Pix, i)
+		return uint16(r), uint16(g), uint16(bl), uint16(a)
+	}
+	sum, total := s.sums(x, y)
+	if total == 0 {
+		return 0, 0, 0, 0
+	}
+	a := clamp(sum[3]/total + 0.5)
+	// A premultiplied channel cannot exceed alpha.
+	channel := func(v float64) uint16 {
+		return clamp(math.Min(v/total+0.5, float64(a)))
+	}
+	return channel(sum[0]), channel(sum[1]), channel(sum[2]), a
+}
+
+// Return the premultiplied color of the float plane interpolated at (x, y), like at without rounding.
+func (s *sampler) atLinear(x float64, y float64) (float64, float64, float64, float64) {
+	if s.filter.radius == 0 {
+		i, ok := s.nearest(x, y)
+		if !ok {
+			return 0, 0, 0, 0
+		}
+		return readFloat(s.fsrc.Pix, i)
+	}
+	sum, total := s.sums(x, y)
+	if total == 0 {
+		return 0, 0, 0, 0
+	}
+	a := clampFloat(sum[3] / total)
+	return clampFloat(math.Min(sum[0]/total, a)), clampFloat(math.Min(sum[1]/total, a)), clampFloat(math.Min(sum[2]/total, a)), a
+}
+
+// Return the offset of the pixel under (x, y) read by the border policy, false if it is skipped.
+func (s *sampler) nearest(x float64, y float64) (int, bool) {
+	b := s.bounds
+	xx, okX := s.border.index(int(math.Floor(x)), b.Min.X, b.Max.X)
+	yy, okY := s.border.index(int(math.Floor(y)), b.Min.Y, b.Max.Y)
+	return (yy-b.Min.Y)*s.stride + (xx-b.Min.X)*s.step, okX && okY
+}
+
+// Return the weighted sums of the rgba channels of the neighbours of (x, y) and their total weight,
+// the weight of the neighbours read with the renormalize border.
+func (s *sampler) sums(x float64, y float64) ([4]float64, float64) {
+	b := s.bounds
+	var totalX, totalY float64
+	s.offsX, s.wX, totalX = s.taps(s.offsX[:0], s.wX[:0], x, s.scaleX, b.Min.X, b.Max.X, s.step)
+	s.offsY, s.wY, totalY = s.taps(s.offsY[:0], s.wY[:0], y, s.scaleY, b.Min.Y, b.Max.Y, s.stride)
+	var sum [4]float64
+	used := float64(0)
+	for j, offY := range s.offsY {
+		if offY < 0 {
+			continue
+		}
+		for i, offX := range s.offsX {
+			if offX < 0 {
+				continue
+			}
+			w := s.wX[i] * s.wY[j]
+			var r, g, bl, a float64
+			if s.fsrc != nil {
+				r, g, bl, a = readFloat(s.fsrc.Pix, offY+offX)
+			} else {
+				r16, g16, b16, a16 := readPixel(s.src.Pix, offY+offX)
+				r, g, bl, a = float64(r16), float64(g16), float64(b16), float64(a16)
+			}
+			sum[0] += r * w
+			sum[1] += g * w
+			sum[2] += bl * w
+			sum[3] += a * w
+			used += w
+		}
+	}
+	if s.border == BorderRenormalize {
+		return sum, used
+	}
+	return sum, totalX * totalY
+}
+
+// Write the image slice from start to end position, whose pixels are interpolated by the filter at the
+// positions of the input given by pos for their coordinates, to the output buffer, or to the output plane
+// if linear. The pixels without a position in the input are transparent.
+func (img *Image) resample(f *filter, border Border, scaleX float64, scaleY float64, linear bool, start int, end int,
+	pos func(x float64, y float64) (float64, float64, bool)) {
+	n := img.out.Bounds().Dx()
+	if linear {
+		s := newFloatSampler(img.fin, f, border, scaleX, scaleY)
+		for k := start; k < end; k++ {
+			var r, g, b, a float64
+			if sx, sy, ok := pos(float64(k%n), float64(k/n)); ok {
+				r, g, b, a = s.atLinear(sx, sy)
+			}
+			writeFloat(img.fout.Pix, floatOffset(k, n, img.fout.Stride), r, g, b, a)
+		}
+		return
+	}
+	s := newSampler(img.in, f, border, scaleX, scaleY)
+	for k := start; k < end; k++ {
+		var r, g, b, a uint16
+		if sx, sy, ok := pos(float64(k%n), float64(k/n)); ok {
+			r, g, b, a = s.at(sx, sy)
+		}
+		writePixel(img.out.Pix, pixOffset(k, n, img.out.Stride), r, g, b, a)
+	}
+}
+
+// Append the Pix offsets, scaled by step, and the weights of the neighbours of the position pos
+// along an axis spanning [lo, hi), and return them with the sum of the weights.
+func (s *sampler) taps(offs []int, weights []float64, pos float64, scale float64, lo int, hi int, step int) ([]int, []float64, float64) {
+	support := s.filter.radius * scale
+	first, last := int(math.Ceil(pos-0.5-support)), int(math.Floor(pos-0.5+support))
+	total := float64(0)
+	for i := first; i <= last; i++ {
+		w := s.filter.weight((float64(i) + 0.5 - pos) / scale)
+		total += w
+		off := -1
+		if j, ok := s.border.index(i, lo, hi); ok {
+			off = (j - lo) * step
+		}
+		offs = append(offs, off)
+		weights = append(weights, w)
+	}
+	return offs, weights, total
+}
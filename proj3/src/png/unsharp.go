@@ -0,0 +1,166 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"image"
+	"math"
+)
+
+func init() {
+	RegisterEffect(EffectSpec{Name: "unsharp", Params: []string{"border", "radius", "amount", "threshold"}, New: newUnsharpEffect})
+}
+
+// The stages of the unsharp mask around the two passes of the gaussian blur.
+const (
+	unsharpKeep    = iota // Keep the original pixels in the scratch plane
+	unsharpCombine        // Add the scaled difference between the original and the blurred pixels
+)
+
+// An unsharpEffect sharpens the image by adding the difference between the image and its gaussian blur,
+// scaled by the amount, to the channels where the difference exceeds the threshold.
+type unsharpEffect struct {
+	radius    float64 // The standard deviation of the gaussian
+	amount    float64
+	threshold float64 // The smallest difference sharpened, as a fraction of the largest value
+	border    Border
+	kernel    *Kernel
+}
+
+// An unsharpStage is one of the stages of the unsharp mask.
+type unsharpStage struct {
+	effect *unsharpEffect
+	phase  int
+}
+
+// Create an unsharp mask, where "radius" is the standard deviation of the blur, 2 by default,
+// "amount" scales the difference, 1 by default, and "threshold" is the smallest difference of a channel
+// that is sharpened, as a fraction of the largest value, 0 by default.
+func newUnsharpEffect(params map[string]any) (Effect, error) {
+	e := &unsharpEffect{}
+	var err error
+	if e.border, err = paramBorder(params, "border"); err != nil {
+		return nil, err
+	}
+	if e.radius, err = paramFloat(params, "radius", 2, math.SmallestNonzeroFloat64, maxGaussianSigma); err != nil {
+		return nil, err
+	}
+	if e.amount, err = paramFloat(params, "amount", 1, 0, maxSharpenAmount); err != nil {
+		return nil, err
+	}
+	if e.threshold, err = paramFloat(params, "threshold", 0, 0, 1); err != nil {
+		return nil, err
+	}
+	weights := gaussianWeights(e.radius)
+	e.kernel = &Kernel{Size: len(weights), Row: weights, Col: weights}
+	return e, nil
+}
+
+func (e *unsharpEffect) Name() string { return "unsharp" }
+
+func (e *unsharpEffect) Params() map[string]any {
+	return map[string]any{"border": e.border.String(), "radius": e.radius, "amount": e.amount, "threshold": e.threshold}
+}
+
+func (e *unsharpEffect) Radius() int { return e.kernel.Radius() }
+
+// Apply the unsharp mask to the image slice. The blur of the slice is first written to the slice
+// of the output buffer, then combined with the original pixels of the input buffer.
+func (e *unsharpEffect) Apply(img *Image, start int, end int) {
+	img.PerformKernel(e.kernel, e.border, start, end)
+	e.combine(img.in, img.out, img.out, start, end)
+}
+
+func (e *unsharpEffect) ApplyLinear(img *Image, start int, end int) {
+	img.performKernelLinear(e.kernel, e.border, start, end)
+	e.combineLinear(img.fin, img.fout, img.fout, start, end)
+}
+
+// The original pixels are kept in a scratch plane while the image is blurred in two passes.
+func (e *unsharpEffect) Stages(img *Image) []Effect {
+	return []Effect{
+		&unsharpStage{e, unsharpKeep},
+		&passEffect{parent: e, weights: e.kernel.Row, horizontal: true, border: e.border},
+		&passEffect{parent: e, weights: e.kernel.Col, horizontal: false, border: e.border},
+		&unsharpStage{e, unsharpCombine},
+	}
+}
+
+// The original pixels are kept in one plane.
+func (e *unsharpEffect) ScratchPlanes() int { return 1 }
+
+func (s *unsharpStage) Name() string { return s.effect.Name() }
+
+func (s *unsharpStage) Params() map[string]any {
+	return s.effect.Params()
+}
+
+func (s *unsharpStage) Radius() int { return 0 }
+
+func (s *unsharpStage) Apply(img *Image, start int, end int) {
+	if s.phase == unsharpKeep {
+		original := img.planes[0]
+		_, _, xMin, xMax := img.GetBounds()
+		n := xMax - xMin
+		for k := start; k < end; k++ {
+			i := pixOffset(k, n, img.in.Stride)
+			copy(original.Pix[pixOffset(k, n, original.Stride):], img.in.Pix[i:i+8])
+		}
+		img.copyThrough(start, end)
+		return
+	}
+	s.effect.combine(img.planes[0], img.in, img.out, start, end)
+}
+
+func (s *unsharpStage) ApplyLinear(img *Image, start int, end int) {
+	if s.phase == unsharpKeep {
+		original := img.fplanes[0]
+		_, _, xMin, xMax := img.GetBounds()
+		n := xMax - xMin
+		for k := start; k < end; k++ {
+			i := floatOffset(k, n, img.fin.Stride)
+			copy(original.Pix[floatOffset(k, n, original.Stride):], img.fin.Pix[i:i+4])
+		}
+		img.copyThroughLinear(start, end)
+		return
+	}
+	s.effect.combineLinear(img.fplanes[0], img.fin, img.fout, start, end)
+}
+
+// Write to out the original pixels sharpened by their difference with the blurred pixels,
+// from start to end position. The alpha channel is the one of the original pixels.
+func (e *unsharpEffect) combine(original *image.RGBA64, blurred *image.RGBA64, out *image.RGBA64, start int, end int) {
+	n := out.Bounds().Dx()
+	threshold := e.threshold * 0xffff
+	for k := start; k < end; k++ {
+		r, g, b, a := readPixel(original.Pix, pixOffset(k, n, original.Stride))
+		br, bg, bb, _ := readPixel(blurred.Pix, pixOffset(k, n, blurred.Stride))
+		rgb := [3]uint16{}
+		for c, v := range [3][2]uint32{{r, br}, {g, bg}, {b, bb}} {
+			rgb[c] = uint16(v[0])
+			if diff := float64(v[0]) - float64(v[1]); math.Abs(diff) > threshold {
+				// A premultiplied channel cannot exceed alpha.
+				rgb[c] = clamp(math.Min(float64(v[0])+e.amount*diff, float64(a)))
+			}
+		}
+		writePixel(out.Pix, pixOffset(k, n, out.Stride), rgb[0], rgb[1], rgb[2], uint16(a))
+	}
+}
+
+// Write to out the original pixels sharpened by their difference with the blurred pixels in linear light,
+// like combine.
+func (e *unsharpEffect) combineLinear(original *floatImage, blurred *floatImage, out *floatImage, start int, end int) {
+	n := out.Rect.Dx()
+	threshold := e.threshold * 0xffff
+	for k := start; k < end; k++ {
+		r, g, b, a := readFloat(original.Pix, floatOffset(k, n, original.Stride))
+		br, bg, bb, _ := readFloat(blurred.Pix, floatOffset(k, n, blurred.Stride))
+		rgb := [3]float64{r, g, b}
+		for c, blur := range [3]float64{br, bg, bb} {
+			if diff := rgb[c] - blur; math.Abs(diff) > threshold {
+				rgb[c] = clampFloat(math.Min(rgb[c]+e.amount*diff, a))
+			}
+		}
+		writeFloat(out.Pix, floatOffset(k, n, out.Stride), rgb[0], rgb[1], rgb[2], a)
+	}
+}
@@ -14,7 +14,9 @@ import (
 type Node struct {
 	InputFile  string
 	OutputFile string
-	Effects    []any
+	Effects    []png.Effect
+	Input      png.LoadOptions
+	Output     png.SaveOptions
 	Next       *Node
 }
 
@@ -26,34 +28,41 @@ type List struct {
 
 // Process the image task.
 func ProcessTask(task *Node) {
-	pngImg, err := png.Load(task.InputFile)
+	pngImg, err := png.LoadWithOptions(task.InputFile, task.Input)
 	if err != nil {
 		panic(err)
 	}
-	yMin, yMax, xMin, xMax := pngImg.GetBounds()
-	bd := (yMax - yMin) * (xMax - xMin)
-	for _, s := range task.Effects {
-		switch s.(string) {
-		case "G":
-			pngImg.Grayscale(0, bd)
-		case "S":
-			pngImg.Sharpen(0, bd)
-		case "E":
-			pngImg.EdgeDetection(0, bd)
-		case "B":
-			pngImg.Blur(0, bd)
+	for _, effect := range task.Effects {
+		// Check the effect parameters again before applying it.
+		if err := png.ValidateEffect(effect); err != nil {
+			panic(err)
 		}
-		// swap the in and out image pointer for applying the next effect.
-		pngImg.Swap()
+		// Check the effect applies to the image, e.g. a crop within its bounds.
+		if err := png.CheckEffect(effect, pngImg); err != nil {
+			panic(err)
+		}
+		// Take the scratch planes of the effect, e.g. the original pixels kept by an unsharp mask.
+		pngImg.AllocatePlanes(effect)
+		// Apply each stage of the effect, e.g. the two passes of a separable blur.
+		for _, stage := range png.Stages(effect, pngImg) {
+			// The output buffer takes the bounds of the stage, e.g. of a resized image.
+			bd := pngImg.Prepare(stage)
+			stage.Apply(pngImg, 0, bd)
+			// swap the in and out image pointer for applying the next stage.
+			pngImg.Swap()
+		}
+		pngImg.ReleasePlanes()
 	}
 	// Counteract the last swap.
 	pngImg.Swap()
 	// Save the image.
-	err = pngImg.Save(task.OutputFile)
+	err = pngImg.SaveWithOptions(task.OutputFile, task.Output)
 	// Check save errors.
 	if err != nil {
 		panic(err)
 	}
+	// Return the buffers to the pool for the next image.
+	pngImg.Release()
 }
 
 // Initialize task lists for threads.
@@ -154,32 +163,23 @@ func CreateTaskLists(config Config, counter *atomic.Int64) []*List {
 	taskLists := InitializeTaskLists(config.ThreadCount)
 	// Generate tasks.
 	for {
-		var m map[string]any
-		var inFilePath, outFilePath string
-		var effects []any
-
-		// A non-nil error indicates the end of JSON file.
-		if err := reader.Decode(&m); err != nil {
-			break
+		spec, err := ReadTaskSpec(reader, config)
+		if err != nil {
+			panic(err)
 		}
-		// Get info for a task.
-		for k, v := range m {
-			switch k {
-			case "inPath":
-				inFilePath = v.(string)
-			case "outPath":
-				outFilePath = v.(string)
-			case "effects":
-				effects = v.([]any)
-			}
+		// A nil spec indicates the end of JSON file.
+		if spec == nil {
+			break
 		}
 		// Iterate through directories.
 		for _, dataDir := range dir {
 			// Create task node.
 			task := &Node{
-				InputFile:  "../data/in/" + dataDir + "/" + inFilePath,
-				OutputFile: "../data/out/" + dataDir + "_" + outFilePath,
-				Effects:    effects,
+				InputFile:  "../data/in/" + dataDir + "/" + spec.InPath,
+				OutputFile: "../data/out/" + dataDir + "_" + spec.OutPath,
+				Effects:    spec.Effects,
+				Input:      spec.Input,
+				Output:     spec.Output,
 				Next:       nil}
 			listIndex := rand.Intn(config.ThreadCount)
 			// Append the task to a random list in tasklists.
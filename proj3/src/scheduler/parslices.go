@@ -12,7 +12,7 @@ import (
 )
 
 type ChunkTask struct {
-	Effect     string
+	Effect     png.Effect
 	PngImg     *png.Image
 	ChunkStart int
 	ChunkEnd   int
@@ -25,17 +25,8 @@ type ListC struct {
 }
 
 // Process the image chunk.
-func SliceChunk(effect string, img *png.Image, chunkStart int, chunkEnd int) {
-	switch effect {
-	case "G":
-		img.Grayscale(chunkStart, chunkEnd)
-	case "S":
-		img.Sharpen(chunkStart, chunkEnd)
-	case "E":
-		img.EdgeDetection(chunkStart, chunkEnd)
-	case "B":
-		img.Blur(chunkStart, chunkEnd)
-	}
+func SliceChunk(effect png.Effect, img *png.Image, chunkStart int, chunkEnd int) {
+	effect.Apply(img, chunkStart, chunkEnd)
 }
 
 // Initialize the task lists
@@ -166,76 +157,79 @@ func RunParallelSlices(config Config) {
 	dir := strings.Split(config.DataDirs, "+")
 
 	for {
-		var m map[string]any
-		var inFilePath, outFilePath string
-		var effects []any
-
-		// A non-nil error indicates the end of JSON file.
-		if err := reader.Decode(&m); err != nil {
-			break
+		spec, err := ReadTaskSpec(reader, config)
+		if err != nil {
+			panic(err)
 		}
-
-		// Get info for an image task.
-		for k, v := range m {
-			switch k {
-			case "inPath":
-				inFilePath = v.(string)
-			case "outPath":
-				outFilePath = v.(string)
-			case "effects":
-				effects = v.([]any)
-			}
+		// A nil spec indicates the end of JSON file.
+		if spec == nil {
+			break
 		}
 
 		// Iterate through directories.
 		for _, dataDir := range dir {
 			// Load image.
-			pngImg, err := png.Load("../data/in/" + dataDir + "/" + inFilePath)
+			pngImg, err := png.LoadWithOptions("../data/in/"+dataDir+"/"+spec.InPath, spec.Input)
 			if err != nil {
 				panic(err)
 			}
-			// Get image bounds
-			yMin, yMax, xMin, xMax := pngImg.GetBounds()
-
 			// Generate 4 tasks for each thread.
-			numPixels := (yMax - yMin) * (xMax - xMin)
 			auxiNumThreads := config.ThreadCount * 4
-			numPixelsPerThread := int(math.Ceil(float64(numPixels) / float64(auxiNumThreads)))
 
 			// Sequentially process the effects using a barrier.
-			for _, effect := range effects {
-				// Create tasks and add to random queue
-				for i := 0; i < auxiNumThreads; i++ {
-					chunkStart := numPixelsPerThread * i
-					if chunkStart > numPixels {
-						chunkStart = numPixels
-					}
-					chunkEnd := chunkStart + numPixelsPerThread
-					if chunkEnd > numPixels {
-						chunkEnd = numPixels
-					}
-					// Randomly add the task to a queue
-					chunkTask := &ChunkTask{Effect: effect.(string), PngImg: pngImg, ChunkStart: chunkStart, ChunkEnd: chunkEnd}
-					EnqueueListChunkVer(taskLists, rand.Intn(config.ThreadCount), chunkTask)
-					counter.Add(1)
+			for _, effect := range spec.Effects {
+				// Check the effect parameters again before applying it.
+				if err := png.ValidateEffect(effect); err != nil {
+					panic(err)
 				}
-				// Wait until all slices are done.
-				if counter.Load() != 0 {
+				// Check the effect applies to the image, e.g. a crop within its bounds.
+				if err := png.CheckEffect(effect, pngImg); err != nil {
+					panic(err)
+				}
+				// Take the scratch planes of the effect, e.g. the original pixels kept by an unsharp mask.
+				pngImg.AllocatePlanes(effect)
+				// Apply each stage of the effect, e.g. the two passes of a separable blur.
+				for _, stage := range png.Stages(effect, pngImg) {
+					// The slices are taken from the output of the stage, which may change the bounds of the image.
+					numPixels := pngImg.Prepare(stage)
+					numPixelsPerThread := int(math.Ceil(float64(numPixels) / float64(auxiNumThreads)))
+					// Create tasks and add to random queue
+					for i := 0; i < auxiNumThreads; i++ {
+						chunkStart := numPixelsPerThread * i
+						if chunkStart > numPixels {
+							chunkStart = numPixels
+						}
+						chunkEnd := chunkStart + numPixelsPerThread
+						if chunkEnd > numPixels {
+							chunkEnd = numPixels
+						}
+						// Randomly add the task to a queue
+						chunkTask := &ChunkTask{Effect: stage, PngImg: pngImg, ChunkStart: chunkStart, ChunkEnd: chunkEnd}
+						EnqueueListChunkVer(taskLists, rand.Intn(config.ThreadCount), chunkTask)
+						counter.Add(1)
+					}
+					// Wait until all slices are done. The counter is checked while holding the lock,
+					// so the signal of the last slice cannot be missed between the check and the wait.
 					c.L.Lock()
-					c.Wait()
+					for counter.Load() != 0 {
+						c.Wait()
+					}
 					c.L.Unlock()
+					// swap the in and out image pointer for applying the next stage.
+					pngImg.Swap()
 				}
-				// swap the in and out image pointer for applying the next effect.
-				pngImg.Swap()
+				pngImg.ReleasePlanes()
 			}
 			// Counteract the last swap.
 			pngImg.Swap()
 			// Save the image.
-			err = pngImg.Save("../data/out/" + dataDir + "_" + outFilePath)
+			err = pngImg.SaveWithOptions("../data/out/"+dataDir+"_"+spec.OutPath, spec.Output)
 			// Check save errors.
 			if err != nil {
 				panic(err)
 			}
+			// Return the buffers to the pool for the next image.
+			pngImg.Release()
 		}
 	}
 	//Signal the end for goroutines.
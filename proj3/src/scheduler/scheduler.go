@@ -1,5 +1,7 @@
 package scheduler
 
+import "os"
+
 type Config struct {
 	DataDirs    string //Represents the data directories to use to load the images.
 	Mode        string // Represents which scheduler scheme to use
@@ -17,4 +19,5 @@ func Schedule(config Config) {
 	} else {
 		panic("Invalid scheduling scheme given.")
 	}
+	reportMemory(os.Stderr)
 }
@@ -47,36 +47,28 @@ func RunSequential(config Config) {
 	dir := strings.Split(config.DataDirs, "+")
 	// Get tasks and append to the list
 	for {
-		var m map[string]interface{}
-		var inFilePath, outFilePath string
-		var effects []interface{}
-
-		// An error indicates the end of JSON file, return.
-		if err := reader.Decode(&m); err != nil {
-			return
+		spec, err := ReadTaskSpec(reader, config)
+		if err != nil {
+			panic(err)
 		}
-		// Get task info.
-		for k, v := range m {
-			switch k {
-			case "inPath":
-				inFilePath = v.(string)
-			case "outPath":
-				outFilePath = v.(string)
-			case "effects":
-				effects = v.([]interface{})
-			}
+		// A nil spec indicates the end of JSON file, return.
+		if spec == nil {
+			return
 		}
 		//Iterate through data directories.
 		for _, dataDir := range dir {
-			_, err := png.Load("../data/in/" + dataDir + "/" + inFilePath)
+			pngImg, err := png.LoadWithOptions("../data/in/"+dataDir+"/"+spec.InPath, spec.Input)
 			if err != nil {
 				panic(err)
 			}
+			pngImg.Release()
 			// Create task node.
 			task := &Node{
-				InputFile:  "../data/in/" + dataDir + "/" + inFilePath,
-				OutputFile: "../data/out/" + dataDir + "_" + outFilePath,
-				Effects:    effects,
+				InputFile:  "../data/in/" + dataDir + "/" + spec.InPath,
+				OutputFile: "../data/out/" + dataDir + "_" + spec.OutPath,
+				Effects:    spec.Effects,
+				Input:      spec.Input,
+				Output:     spec.Output,
 				Next:       nil}
 			// Enqueue task to the list.
 			EnqueueUniqueList(tasklist, task)
@@ -0,0 +1,245 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"proj3/png"
+)
+
+// The image task description given by a JSON string in effects.txt.
+type TaskSpec struct {
+	InPath  string
+	OutPath string
+	Effects []png.Effect    // The effects applied in order
+	Input   png.LoadOptions // How the input image is loaded
+	Output  png.SaveOptions // How the output image is saved
+}
+
+// The border policies given by the "border" entry of a task.
+type taskBorders struct {
+	all     string            // The mode of every effect taking a border, if not empty
+	effects map[string]string // The mode of each effect, by the name used in the task
+}
+
+// Read the next image task description from effects.txt.
+// Return nil at the end of the JSON file, or an error for a malformed line.
+func ReadTaskSpec(reader *json.Decoder, config Config) (*TaskSpec, error) {
+	var m map[string]any
+	if err := reader.Decode(&m); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// The input image is converted by as many goroutines as the configured number of threads,
+	// into buffers recycled from the previous images.
+	spec := &TaskSpec{Input: png.LoadOptions{Threads: config.ThreadCount, Pool: buffers}}
+	borders := taskBorders{effects: make(map[string]string)}
+	var effects any
+	// Get info for a task.
+	for k, v := range m {
+		switch k {
+		case "inPath":
+			spec.InPath = v.(string)
+		case "outPath":
+			spec.OutPath = v.(string)
+		case "effects":
+			effects = v
+		case "border":
+			if err := parseBorders(v, &borders); err != nil {
+				return nil, err
+			}
+		case "input":
+			if err := parseInput(v, &spec.Input); err != nil {
+				return nil, err
+			}
+		case "output":
+			if err := parseOutput(v, &spec.Output, config); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// The effects are created once the border policies are known.
+	if effects != nil {
+		var err error
+		if spec.Effects, err = parseEffects(effects, borders); err != nil {
+			return nil, err
+		}
+	}
+	// The output file is renamed with the extension of the requested format.
+	if spec.Output.Format != "" {
+		spec.OutPath = spec.Output.Format.ReplaceExt(spec.OutPath)
+	}
+	return spec, nil
+}
+
+// Parse the "effects" entry of a task into the registered effects. An effect is either a name,
+// e.g. "G" or "blur", or an object with a name and parameters, e.g. {"name": "blur", "radius": 4}.
+// The effects taking a border parameter get the border policy of the task, unless they have their own.
+func parseEffects(v any, borders taskBorders) ([]png.Effect, error) {
+	entries, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid effects entry %v", v)
+	}
+	effects := make([]png.Effect, 0, len(entries))
+	for _, entry := range entries {
+		var name string
+		params := make(map[string]any)
+		switch e := entry.(type) {
+		case string:
+			name = e
+		case map[string]any:
+			if name, ok = e["name"].(string); !ok {
+				return nil, fmt.Errorf("effect %v has no name", entry)
+			}
+			for k, v := range e {
+				if k != "name" {
+					params[k] = v
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid effect %v", entry)
+		}
+		if effectSpec, ok := png.LookupEffect(name); ok && effectSpec.Takes("border") && params["border"] == nil {
+			if mode, ok := borders.effects[name]; ok {
+				params["border"] = mode
+			} else if mode, ok := borders.effects[effectSpec.Name]; ok {
+				params["border"] = mode
+			} else if borders.all != "" {
+				params["border"] = borders.all
+			}
+		}
+		effect, err := png.NewEffect(name, params)
+		if err != nil {
+			return nil, err
+		}
+		effects = append(effects, effect)
+	}
+	return effects, nil
+}
+
+// Parse the "border" entry of a task, which is either a single mode for all convolution effects,
+// e.g. "clamp", or a mode per effect, e.g. {"B": "mirror", "E": "clamp"}.
+func parseBorders(v any, borders *taskBorders) error {
+	switch modes := v.(type) {
+	case string:
+		if _, err := png.ParseBorder(modes); err != nil {
+			return err
+		}
+		borders.all = modes
+	case map[string]any:
+		for effect, mode := range modes {
+			name, ok := mode.(string)
+			if !ok {
+				return fmt.Errorf("border mode of effect %q is not a string", effect)
+			}
+			if _, err := png.ParseBorder(name); err != nil {
+				return err
+			}
+			borders.effects[effect] = name
+		}
+	default:
+		return fmt.Errorf("invalid border entry %v", v)
+	}
+	return nil
+}
+
+// Parse the "input" entry of a task, e.g. {"linear": true}.
+// A linear input is converted to linear light for the effects and back to sRGB when saved.
+func parseInput(v any, options *png.LoadOptions) error {
+	entries, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid input entry %v", v)
+	}
+	for k, v := range entries {
+		switch k {
+		case "linear":
+			if options.Linear, ok = v.(bool); !ok {
+				return fmt.Errorf("input option %q must be a boolean, got %v", k, v)
+			}
+		default:
+			return fmt.Errorf("unknown input option %q", k)
+		}
+	}
+	return nil
+}
+
+// Parse the "output" entry of a task, e.g.
+// {"format": "png", "bitDepth": 8, "dropAlpha": false, "compression": 9, "grayscale": true, "palette": true, "parallel": true}.
+// A parallel output is compressed by as many goroutines as the configured number of threads.
+func parseOutput(v any, options *png.SaveOptions, config Config) error {
+	entries, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid output entry %v", v)
+	}
+	for k, v := range entries {
+		var err error
+		switch k {
+		case "format":
+			var name string
+			if name, err = outputString(k, v); err == nil {
+				options.Format, err = png.ParseFormat(name)
+			}
+		case "bitDepth":
+			var depth int
+			if depth, err = outputInt(k, v, 1, 16); err == nil && depth != 1 && depth != 8 && depth != 16 {
+				err = fmt.Errorf("output bit depth must be 1, 8 or 16, got %v", depth)
+			}
+			options.BitDepth = depth
+		case "dropAlpha":
+			var drop bool
+			drop, err = outputBool(k, v)
+			options.KeepAlpha = !drop
+		case "compression":
+			var level int
+			if level, err = outputInt(k, v, 0, 9); err == nil {
+				options.CompressionLevel = level
+				if level == 0 {
+					options.CompressionLevel = png.NoCompression
+				}
+			}
+		case "grayscale":
+			options.Grayscale, err = outputBool(k, v)
+		case "palette":
+			options.Palette, err = outputBool(k, v)
+		case "parallel":
+			var parallel bool
+			if parallel, err = outputBool(k, v); err == nil && parallel {
+				options.Threads = config.ThreadCount
+			}
+		default:
+			err = fmt.Errorf("unknown output option %q", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the string value of an output option.
+func outputString(k string, v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("output option %q must be a string, got %v", k, v)
+	}
+	return s, nil
+}
+
+// Return the boolean value of an output option.
+func outputBool(k string, v any) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("output option %q must be a boolean, got %v", k, v)
+	}
+	return b, nil
+}
+
+// Return the integer value of an output option within [lo, hi].
+func outputInt(k string, v any, lo int, hi int) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) || int(f) < lo || int(f) > hi {
+		return 0, fmt.Errorf("output option %q must be an integer from %v to %v, got %v", k, lo, hi, v)
+	}
+	return int(f), nil
+}